@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sitesAPI serves the /api/sites REST endpoints:
+//
+//	GET    /api/sites             lists all sites (admin)
+//	POST   /api/sites             registers a site (admin)
+//	GET    /api/sites/{hostname}  shows a site
+//	PATCH  /api/sites/{hostname}  changes some of a site's fields
+//	DELETE /api/sites/{hostname}  removes a site and its files
+//	GET    /api/sites/{hostname}/releases  lists the site's releases
+//	POST   /api/sites/{hostname}/rollback?to={release}  deploys a release
+//	                                                     again, the previous
+//	                                                     one by default
+//	GET    /api/sites/{hostname}/uploads         lists the failed uploads
+//	POST   /api/sites/{hostname}/uploads/replay  retries them, dead letters
+//	                                             included
+//
+// Secrets are never part of the responses, except for the APISecret of a
+// newly registered site.
+type sitesAPI struct {
+	sites SiteStore
+	queue *BuildQueue
+}
+
+// The fields of a site that can be changed through PATCH.
+type sitePatch struct {
+	Name,
+	Email,
+	BaseURL,
+	CloneURLType,
+	CloneURL,
+	Branch,
+	SourceDir,
+	AccessToken *string
+
+	Submodules,
+	LFS *bool
+
+	Timeouts *PhaseTimeouts
+
+	// Replaces the site's deploy key with a new one.
+	NewDeployKey bool
+}
+
+func (a *sitesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sites"), "/")
+	hostname, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		hostname, action = path[:i], path[i+1:]
+	}
+
+	if hostname == "" {
+		if err := authorizeAdmin(r); err != nil {
+			authFailed(w, err)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			a.list(w, r)
+		case "POST":
+			a.post(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+		return
+	}
+
+	site, ok, err := authorizeHost(r, a.sites, hostname, true)
+	if err != nil {
+		authFailed(w, err)
+		return
+	}
+	if !ok {
+		sendResponse(w, APIResponse{
+			Code:    404,
+			Message: "Host not found",
+		})
+		return
+	}
+
+	switch action {
+	case "":
+	case "releases":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		a.releases(w, r, site)
+		return
+	case "rollback":
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		a.rollback(w, r, site)
+		return
+	case "uploads":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		a.listUploads(w, r, site)
+		return
+	case "uploads/replay":
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		a.replayUploads(w, r, site)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		sendResponse(w, APIResponse{
+			Code:    200,
+			Message: site.HostName,
+			Data:    site.Redacted(),
+		})
+	case "PATCH":
+		a.patch(w, r, site)
+	case "DELETE":
+		a.delete(w, r, site)
+	default:
+		methodNotAllowed(w, "GET, PATCH, DELETE")
+	}
+}
+
+func (a *sitesAPI) list(w http.ResponseWriter, r *http.Request) {
+	sites := []SiteConf{}
+	for _, s := range a.sites.All() {
+		sites = append(sites, s.Redacted())
+	}
+
+	sendResponse(w, APIResponse{
+		Code:    200,
+		Message: fmt.Sprintf("%d sites", len(sites)),
+		Data:    sites,
+	})
+}
+
+func (a *sitesAPI) post(w http.ResponseWriter, r *http.Request) {
+	newSite := SiteConf{}
+	if err := json.NewDecoder(r.Body).Decode(&newSite); err != nil {
+		sendResponse(w, APIResponse{
+			Code:    400,
+			Message: fmt.Sprintf("Malformed site: %v", err),
+		})
+		return
+	}
+
+	newSite, errs, err := a.create(newSite)
+	if len(errs) > 0 {
+		invalidFields(w, errs)
+		return
+	} else if err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: fmt.Sprintf("Could not save the site: %v", err),
+		})
+		return
+	}
+
+	data := newSite.Redacted()
+	data.APISecret = newSite.APISecret
+	sendResponse(w, APIResponse{
+		Code:    201,
+		Message: newSite.APISecret,
+		Data:    data,
+	})
+}
+
+// create validates and registers a new site, gives it a fresh APISecret and
+// deploy key, and queues its first build. It returns the site as
+// registered, or the reasons it was refused.
+func (a *sitesAPI) create(newSite SiteConf) (SiteConf, []FieldError, error) {
+	normalizeSite(&newSite)
+	if errs := validateSite(newSite, a.sites.All()); len(errs) > 0 {
+		return newSite, errs, nil
+	}
+
+	newUUID, _ := uuid.NewV4()
+	newSite.APISecret = newUUID.String()
+
+	token := newSite.AccessToken
+	if err := sealSecrets(&newSite, &token, true); err != nil {
+		return newSite, nil, err
+	}
+
+	// Stays set until the first build has cloned the source
+	newSite.NeedsDeployment = true
+
+	if err := a.sites.Add(newSite); err == ErrSiteExists {
+		return newSite, []FieldError{{"HostName", fmt.Sprintf("%q is already registered", newSite.HostName)}}, nil
+	} else if err != nil {
+		return newSite, nil, err
+	}
+
+	a.queue.Enqueue(NewBuild(newSite, "add"))
+
+	return newSite, nil, nil
+}
+
+func (a *sitesAPI) patch(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	patch := sitePatch{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		sendResponse(w, APIResponse{
+			Code:    400,
+			Message: fmt.Sprintf("Malformed site: %v", err),
+		})
+		return
+	}
+
+	patched := site
+	patch.apply(&patched)
+	setIfGiven(&patched.AccessToken, patch.AccessToken)
+
+	// Only the admin knows whose directories are under local_root
+	localChanged := patched.CloneURLType != site.CloneURLType || patched.CloneURL != site.CloneURL
+	if patched.CloneURLType == "local" && localChanged && authorizeAdmin(r) != nil {
+		sendResponse(w, APIResponse{
+			Code:    403,
+			Message: "Only the admin can change local sources",
+		})
+		return
+	}
+
+	others := []SiteConf{}
+	for _, s := range a.sites.All() {
+		if s.HostName != site.HostName {
+			others = append(others, s)
+		}
+	}
+	if errs := validateSite(patched, others); len(errs) > 0 {
+		invalidFields(w, errs)
+		return
+	}
+
+	if err := sealSecrets(&patched, patch.AccessToken, patch.NewDeployKey); err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: fmt.Sprintf("Could not save the site: %v", err),
+		})
+		return
+	}
+
+	// Applied to the site as it is now rather than to the snapshot checked
+	// above, so that what changed meanwhile, a build's progress for one, is
+	// kept.
+	site, err := a.sites.Update(site.HostName, func(s *SiteConf) error {
+		old := *s
+		patch.apply(s)
+		if patch.AccessToken != nil {
+			s.AccessToken = patched.AccessToken
+		}
+		if patch.NewDeployKey {
+			s.DeployKey, s.DeployKeyPublic = patched.DeployKey, patched.DeployKeyPublic
+		}
+
+		// A different repository or branch needs a fresh checkout, which
+		// the build makes in place of the old one.
+		if s.CloneURLType != old.CloneURLType || s.CloneURL != old.CloneURL || s.Branch != old.Branch {
+			s.NeedsDeployment = true
+		}
+		return nil
+	})
+	if err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: fmt.Sprintf("Could not save the site: %v", err),
+		})
+		return
+	}
+
+	a.queue.Enqueue(NewBuild(site, "api"))
+
+	sendResponse(w, APIResponse{
+		Code:    200,
+		Message: site.HostName,
+		Data:    site.Redacted(),
+	})
+}
+
+func (a *sitesAPI) delete(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	hostname := site.HostName
+
+	// Nothing may write to the site's directories once they are removed
+	a.queue.Stop(hostname)
+
+	if err := a.sites.Delete(hostname); err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: fmt.Sprintf("Could not delete the site: %v", err),
+		})
+		return
+	}
+
+	// Reconcile the deployment should the host name come back
+	setDeployed(hostname, nil)
+	if err := uploads.Remove(hostname); err != nil {
+		log.Printf("[%s] Could not remove the failed uploads: %v", hostname, err)
+	}
+
+	// Host names registered before they were validated could point
+	// anywhere, only remove directories that are really the site's.
+	src, gen, out := siteDirs(hostname)
+	deploy := filepath.Join(basedir, deploydir, hostname)
+	for _, dir := range []string{src, gen, out, deploy, releasesDir(hostname)} {
+		if filepath.Base(dir) != hostname || strings.HasPrefix(hostname, ".") {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[%s] Could not remove %s: %v", hostname, dir, err)
+		}
+	}
+	os.Remove(src + ".etag") // kept by archive sources
+
+	sendResponse(w, APIResponse{
+		Code:    200,
+		Message: fmt.Sprintf("Site %s deleted", hostname),
+	})
+}
+
+// sealSecrets gives the site a new deploy key if newKey is set, and stores
+// token, when given, as its encrypted access token. An empty token removes
+// it.
+func sealSecrets(site *SiteConf, token *string, newKey bool) error {
+	if newKey {
+		private, public, err := newDeployKey(site.HostName)
+		if err != nil {
+			return err
+		}
+		if site.DeployKey, err = encryptSecret(site.HostName, private); err != nil {
+			return err
+		}
+		site.DeployKeyPublic = public
+	}
+
+	if token != nil {
+		site.AccessToken = ""
+		if *token != "" {
+			enc, err := encryptSecret(site.HostName, *token)
+			if err != nil {
+				return err
+			}
+			site.AccessToken = enc
+		}
+	}
+	return nil
+}
+
+// apply sets the fields given by the patch on the site, except for the
+// secrets, which sealSecrets sets.
+func (p sitePatch) apply(site *SiteConf) {
+	setIfGiven(&site.Name, p.Name)
+	setIfGiven(&site.Email, p.Email)
+	setIfGiven(&site.BaseURL, p.BaseURL)
+	setIfGiven(&site.CloneURLType, p.CloneURLType)
+	setIfGiven(&site.CloneURL, p.CloneURL)
+	setIfGiven(&site.Branch, p.Branch)
+	setIfGiven(&site.SourceDir, p.SourceDir)
+	if p.Submodules != nil {
+		site.Submodules = *p.Submodules
+	}
+	if p.LFS != nil {
+		site.LFS = *p.LFS
+	}
+	if p.Timeouts != nil {
+		site.Timeouts = *p.Timeouts
+	}
+	normalizeSite(site)
+}
+
+// Overwrites dst with the value pointed to by src, if any.
+func setIfGiven(dst *string, src *string) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// releases lists the releases of the site, newest first.
+func (a *sitesAPI) releases(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	releases, err := listReleases(site.HostName)
+	if err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	sendResponse(w, APIResponse{
+		Code:    200,
+		Message: fmt.Sprintf("%d releases", len(releases)),
+		Data:    releases,
+	})
+}
+
+// rollback queues a build deploying an old release of the site again.
+func (a *sitesAPI) rollback(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	id := r.URL.Query().Get("to")
+	if id == "" {
+		id = previousRelease(site.HostName)
+	}
+	if _, _, err := getRelease(site.HostName, id); err != nil {
+		sendResponse(w, APIResponse{
+			Code:    404,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	b := NewBuild(site, "rollback")
+	b.Rollback = id
+	build, coalesced := a.queue.Enqueue(b)
+
+	msg := "Rollback queued"
+	if coalesced {
+		msg = "Rollback queued in place of the waiting build"
+	}
+	sendResponse(w, APIResponse{
+		Code:    202,
+		Message: msg,
+		Data:    build,
+	})
+}
+
+// listUploads lists the failed uploads of the site, the dead letters included.
+func (a *sitesAPI) listUploads(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	list, err := uploads.List(site.HostName)
+	if err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	dead := 0
+	for _, u := range list {
+		if u.Dead {
+			dead++
+		}
+	}
+	sendResponse(w, APIResponse{
+		Code:    200,
+		Message: fmt.Sprintf("%d failed uploads, %d given up on", len(list), dead),
+		Data:    list,
+	})
+}
+
+// replayUploads brings back the dead letters of the site, and queues a build
+// retrying its failed uploads.
+func (a *sitesAPI) replayUploads(w http.ResponseWriter, r *http.Request, site SiteConf) {
+	n, err := uploads.Replay(site.HostName)
+	if err != nil {
+		sendResponse(w, APIResponse{
+			Code:    500,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	build, _ := a.queue.Enqueue(newRetryBuild(site))
+	sendResponse(w, APIResponse{
+		Code:    202,
+		Message: fmt.Sprintf("Retrying failed uploads, %d given up on", n),
+		Data:    build,
+	})
+}
+
+// methodNotAllowed tells the client which methods the endpoint takes.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	sendResponse(w, APIResponse{
+		Code:    405,
+		Message: "Method not allowed",
+	})
+}
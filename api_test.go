@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the sites API over a store holding the given sites, in dir.
+func testSitesAPI(t *testing.T, dir string, sites ...SiteConf) *sitesAPI {
+	sitesfile := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(sitesfile, []byte("[]"), 0644)
+	store, err := OpenJSONSiteStore(sitesfile, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sites {
+		if err := store.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &sitesAPI{sites: store, queue: NewBuildQueue(store)}
+}
+
+func TestPatchLocalSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir, root, secret string) { basedir, localroot, adminSecret = dir, root, secret }(basedir, localroot, adminSecret)
+	basedir, localroot, adminSecret = dir, filepath.Join(dir, "local"), "admin"
+	os.MkdirAll(filepath.Join(localroot, "other.example.com"), 0755)
+
+	a := testSitesAPI(t, dir, SiteConf{
+		HostName:     "a.example.com",
+		APISecret:    "site",
+		CloneURLType: "git",
+		CloneURL:     "https://example.com/a.git",
+	})
+	patch := func(secret string) int {
+		body := `{"CloneURLType": "local", "CloneURL": "other.example.com"}`
+		r := httptest.NewRequest("PATCH", "/api/sites/a.example.com", strings.NewReader(body))
+		r.Header.Set(SecretHeader, secret)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := patch("site"); code != http.StatusForbidden {
+		t.Errorf("Expected a site to be refused a local source got %d", code)
+	}
+	if site, _ := a.sites.Get("a.example.com"); site.CloneURLType != "git" {
+		t.Errorf("Expected the site to be left alone got %+v", site)
+	}
+	if code := patch("admin"); code != http.StatusOK {
+		t.Errorf("Expected the admin to set a local source got %d", code)
+	}
+}
+
+func TestUnknownSite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(secret string) { adminSecret = secret }(adminSecret)
+	adminSecret = "admin"
+
+	a := testSitesAPI(t, dir, SiteConf{HostName: "a.example.com", APISecret: "site"})
+	get := func(hostname, secret string) int {
+		r := httptest.NewRequest("GET", "/api/sites/"+hostname, nil)
+		if secret != "" {
+			r.Header.Set(SecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Registered or not, a host looks the same to strangers
+	for _, secret := range []string{"", "nope"} {
+		if known, unknown := get("a.example.com", secret), get("b.example.com", secret); known != unknown {
+			t.Errorf("Expected %d for an unknown host got %d", known, unknown)
+		}
+	}
+	if code := get("b.example.com", "site"); code != http.StatusForbidden {
+		t.Errorf("Expected a site's secret to be refused for another host got %d", code)
+	}
+	if code := get("b.example.com", "admin"); code != http.StatusNotFound {
+		t.Errorf("Expected the admin to be told the host is unknown got %d", code)
+	}
+}
+
+func TestPatchKeepsConcurrentChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+
+	site := SiteConf{
+		HostName:     "a.example.com",
+		APISecret:    "site",
+		CloneURLType: "git",
+		CloneURL:     "https://example.com/a.git",
+	}
+	a := testSitesAPI(t, dir, site)
+	patch := func(body string) {
+		r := httptest.NewRequest("PATCH", "/api/sites/a.example.com", strings.NewReader(body))
+		r.Header.Set(SecretHeader, "site")
+		w := httptest.NewRecorder()
+		a.patch(w, r, site)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the patch to succeed got %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	// A build changed the site since the handler's snapshot was taken
+	a.sites.Update(site.HostName, func(s *SiteConf) error {
+		s.Email = "build@example.com"
+		return nil
+	})
+	patch(`{"Name": "A"}`)
+	if got, _ := a.sites.Get(site.HostName); got.Name != "A" || got.Email != "build@example.com" || got.NeedsDeployment {
+		t.Errorf("Expected only the name to change got %+v", got)
+	}
+
+	// The build makes the fresh checkout a new source needs
+	patch(`{"CloneURL": "https://example.com/b.git"}`)
+	if got, _ := a.sites.Get(site.HostName); !got.NeedsDeployment {
+		t.Errorf("Expected a new source to need a fresh checkout got %+v", got)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrArchiveTooLarge = errors.New("Archive is too large")
+	ErrArchivePath     = errors.New("Archive holds a path outside of its root")
+)
+
+// Largest archive downloaded, and largest size it may unpack to.
+const maxArchiveSize = 1 << 30
+
+// Client used to download archives.
+var archiveClient = &http.Client{Timeout: 5 * time.Minute}
+
+// archiveFetcher downloads a .tar, .tar.gz or .zip archive from CloneURL and
+// unpacks it. The ETag of the archive is kept next to the source directory,
+// so an unchanged archive isn't downloaded again. The revision is the ETag,
+// or a hash of the archive if the server sends none.
+//
+// Archives holding everything in a single directory, as GitHub's do, are
+// unpacked from inside that directory.
+type archiveFetcher struct{}
+
+func (archiveFetcher) Fetch(ctx context.Context, job SiteConf, src string, out io.Writer) (string, error) {
+	etagFile := src + ".etag"
+	etag := ""
+	if _, err := os.Stat(src); err == nil && !job.NeedsDeployment {
+		if b, err := ioutil.ReadFile(etagFile); err == nil {
+			etag = string(b)
+		}
+	}
+
+	log.Printf("Downloading from source...")
+	fmt.Fprintf(out, "GET %s\n", job.CloneURL)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", job.CloneURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := archiveClient.Do(req)
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
+	defer resp.Body.Close()
+	fmt.Fprintf(out, "%s\n", resp.Status)
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return strings.Trim(etag, `"`), nil
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("downloading archive: %s", resp.Status)
+	}
+
+	// Zip files can't be read as a stream, so keep the archive around
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(src), "."+filepath.Base(src)+".download.")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxArchiveSize+1))
+	if err != nil {
+		return "", contextError(ctx, err)
+	}
+	if n > maxArchiveSize {
+		return "", ErrArchiveTooLarge
+	}
+	fmt.Fprintf(out, "Downloaded %d bytes\n", n)
+
+	tmp, err := tempDirFor(src)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := unpackArchive(ctx, f, n, tmp, out); err != nil {
+		return "", fmt.Errorf("unpacking archive: %v", contextError(ctx, err))
+	}
+	if err := replaceDir(src, archiveRoot(tmp)); err != nil {
+		return "", err
+	}
+
+	etag = resp.Header.Get("ETag")
+	if etag == "" {
+		os.Remove(etagFile)
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	if err := ioutil.WriteFile(etagFile, []byte(etag), 0644); err != nil {
+		log.Printf("Error while saving the ETag of %s: %v", job.HostName, err)
+	}
+	return strings.Trim(etag, `"`), nil
+}
+
+// Unpacks the archive in f, of size n, into the directory dest until ctx is
+// done, telling zip files and (gzipped) tarballs apart by their first bytes.
+func unpackArchive(ctx context.Context, f *os.File, n int64, dest string, out io.Writer) error {
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+
+	u := &unpacker{ctx: ctx, dest: dest, out: out}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return u.zip(f, n)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		gz, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return u.tar(gz)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	return u.tar(f)
+}
+
+// unpacker writes the entries of an archive below dest, keeping track of
+// how much it wrote.
+type unpacker struct {
+	ctx     context.Context
+	dest    string
+	out     io.Writer
+	written int64
+}
+
+func (u *unpacker) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = u.dir(hdr.Name)
+		case tar.TypeReg:
+			err = u.file(hdr.Name, tr, os.FileMode(hdr.Mode))
+		default:
+			fmt.Fprintf(u.out, "Skipping %s: not a regular file\n", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (u *unpacker) zip(f *os.File, n int64) error {
+	zr, err := zip.NewReader(f, n)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = u.dir(zf.Name)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = zf.Open(); err == nil {
+				err = u.file(zf.Name, rc, mode)
+				rc.Close()
+			}
+		default:
+			fmt.Fprintf(u.out, "Skipping %s: not a regular file\n", zf.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns where the entry called name goes, refusing names leading out of
+// the destination.
+func (u *unpacker) path(name string) (string, error) {
+	if err := u.ctx.Err(); err != nil {
+		return "", err
+	}
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") {
+		return "", ErrArchivePath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", ErrArchivePath
+		}
+	}
+	return filepath.Join(u.dest, filepath.FromSlash(path.Clean(name))), nil
+}
+
+func (u *unpacker) dir(name string) error {
+	p, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (u *unpacker) file(name string, r io.Reader, mode os.FileMode) error {
+	p, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// Only keep the executable bit, the rest is up to us
+	perm := os.FileMode(0644)
+	if mode&0100 != 0 {
+		perm = 0755
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, maxArchiveSize-u.written+1))
+	u.written += n
+	if err == nil && u.written > maxArchiveSize {
+		err = ErrArchiveTooLarge
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Returns the directory an archive unpacked into dir should be used from:
+// its only subdirectory if that is all there is, or dir itself.
+func archiveRoot(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return dir
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAuthMissing = errors.New("Missing API credentials")
+	ErrAuthInvalid = errors.New("Invalid API credentials")
+	ErrAuthExpired = errors.New("Signed request has expired")
+)
+
+// Header carrying a site's APISecret (or the admin secret for admin-only
+// endpoints). An "Authorization: Bearer <secret>" header is accepted too.
+const SecretHeader = "X-API-Secret"
+
+// How far a signed request's timestamp may drift from our clock.
+var maxSignatureSkew = 5 * time.Minute
+
+// Admin credential guarding the endpoints that are not tied to one site,
+// read from the [api] section of the global config file.
+var adminSecret = ""
+
+// Secret of the hosts that aren't registered, which nobody knows: requests
+// for them fail the same way as requests with wrong credentials do.
+var unknownHostSecret = randomSecret()
+
+// authorizeSite checks that the request proves knowledge of the site's
+// APISecret. Two forms are accepted:
+//
+//   - the secret itself, in the X-API-Secret or Authorization header
+//   - an HMAC-signed query: ts=<unix time>&sig=<hex hmac-sha256>, where the
+//     signature is computed with the secret over "<hostname>\n<ts>"
+//
+// The signed form lets the secret stay out of URLs and proxy logs.
+func authorizeSite(r *http.Request, site SiteConf) error {
+	if secret := requestSecret(r); secret != "" {
+		if !secretsEqual(secret, site.APISecret) {
+			return ErrAuthInvalid
+		}
+		return nil
+	}
+
+	q := r.URL.Query()
+	ts, sig := q.Get("ts"), q.Get("sig")
+	if ts == "" || sig == "" {
+		return ErrAuthMissing
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrAuthInvalid
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return ErrAuthExpired
+	}
+
+	if !secretsEqual(sig, signRequest(site.APISecret, site.HostName, ts)) {
+		return ErrAuthInvalid
+	}
+	return nil
+}
+
+// authorizeAdmin checks the request carries the admin secret. When no admin
+// secret is configured every request is refused.
+func authorizeAdmin(r *http.Request) error {
+	secret := requestSecret(r)
+	switch {
+	case secret == "":
+		return ErrAuthMissing
+	case adminSecret == "" || !secretsEqual(secret, adminSecret):
+		return ErrAuthInvalid
+	}
+	return nil
+}
+
+// authorizeSiteOrAdmin accepts either the site's credentials or the admin
+// secret. A nil site only accepts the admin secret.
+func authorizeSiteOrAdmin(r *http.Request, site *SiteConf) error {
+	if authorizeAdmin(r) == nil {
+		return nil
+	}
+	if site == nil {
+		return authorizeAdmin(r)
+	}
+	return authorizeSite(r, *site)
+}
+
+// authorizeHost looks up the site of hostname and checks the request
+// against its credentials, or the admin's too when admin is set. Unknown
+// hosts fail like wrong credentials, so that nobody learns which host names
+// are registered: only the admin gets to see ok unset.
+func authorizeHost(r *http.Request, store SiteStore, hostname string, admin bool) (site SiteConf, ok bool, err error) {
+	site, ok = store.Get(hostname)
+	check := site
+	if !ok {
+		check = SiteConf{HostName: hostname, APISecret: unknownHostSecret}
+	}
+	if admin {
+		err = authorizeSiteOrAdmin(r, &check)
+	} else {
+		err = authorizeSite(r, check)
+	}
+	return site, ok, err
+}
+
+// Returns a random secret, in hex.
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// signRequest returns the hex encoded signature expected in the sig query
+// parameter for the given site and timestamp.
+func signRequest(secret, hostname, ts string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(hostname + "\n" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Extracts the secret from the request headers, if any.
+func requestSecret(r *http.Request) string {
+	if secret := r.Header.Get(SecretHeader); secret != "" {
+		return secret
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// Compares two secrets in constant time.
+func secretsEqual(a, b string) bool {
+	return len(b) > 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authFailed writes the APIResponse matching an authorization error:
+// 401 when no credentials were given, 403 when they were wrong.
+func authFailed(w http.ResponseWriter, err error) {
+	code := uint(http.StatusForbidden)
+	if err == ErrAuthMissing {
+		code = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	sendResponse(w, APIResponse{
+		Code:    code,
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeSite(t *testing.T) {
+	site := SiteConf{HostName: "blog.example.com", APISecret: "s3cr3t"}
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	old := fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix())
+
+	tests := map[string]struct {
+		url    string
+		header string
+		err    error
+	}{
+		"no credentials": {"/update/?hostname=blog.example.com", "", ErrAuthMissing},
+		"good header":    {"/update/?hostname=blog.example.com", "s3cr3t", nil},
+		"bad header":     {"/update/?hostname=blog.example.com", "guess", ErrAuthInvalid},
+		"good signature": {"/update/?hostname=blog.example.com&ts=" + now + "&sig=" + signRequest("s3cr3t", site.HostName, now), "", nil},
+		"bad signature":  {"/update/?hostname=blog.example.com&ts=" + now + "&sig=" + signRequest("guess", site.HostName, now), "", ErrAuthInvalid},
+		"old signature":  {"/update/?hostname=blog.example.com&ts=" + old + "&sig=" + signRequest("s3cr3t", site.HostName, old), "", ErrAuthExpired},
+	}
+
+	for name, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set(SecretHeader, test.header)
+		}
+		if err := authorizeSite(r, site); err != test.err {
+			t.Errorf("Expected error [%v] got [%v] for [%s]", test.err, err, name)
+		}
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	defer func(s string) { adminSecret = s }(adminSecret)
+
+	r, _ := http.NewRequest("GET", "/add/", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+
+	adminSecret = ""
+	if err := authorizeAdmin(r); err != ErrAuthInvalid {
+		t.Errorf("Expected an unconfigured admin secret to refuse everything, got [%v]", err)
+	}
+
+	adminSecret = "admin"
+	if err := authorizeAdmin(r); err != nil {
+		t.Errorf("Expected admin bearer token to be accepted, got [%v]", err)
+	}
+}
+
+func TestAuthorizeHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s string) { adminSecret = s }(adminSecret)
+	adminSecret = "admin"
+	store := testSitesAPI(t, dir, SiteConf{HostName: "blog.example.com", APISecret: "s3cr3t"}).sites
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+	for _, secret := range []string{"", "guess", "s3cr3t"} {
+		for _, admin := range []bool{false, true} {
+			r, _ := http.NewRequest("GET", "/?ts="+now+"&sig="+signRequest("", "other.example.com", now), nil)
+			if secret != "" {
+				r.Header.Set(SecretHeader, secret)
+			}
+			_, known, _ := authorizeHost(r, store, "blog.example.com", admin)
+			_, ok, err := authorizeHost(r, store, "other.example.com", admin)
+			if !known || ok || err == nil {
+				t.Errorf("Expected [%s] to be refused for an unknown host got %v", secret, err)
+			}
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set(SecretHeader, "admin")
+	if _, ok, err := authorizeHost(r, store, "other.example.com", true); ok || err != nil {
+		t.Errorf("Expected the admin to learn the host is unknown got %v", err)
+	}
+	if _, _, err := authorizeHost(r, store, "blog.example.com", false); err != ErrAuthInvalid {
+		t.Errorf("Expected the admin secret to be refused for site only endpoints got %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBuildNotFound = errors.New("Build not found")
+)
+
+// Phases a build goes through. A build ends either succeeded, failed or
+// canceled.
+const (
+	PhaseQueued     = "queued"
+	PhaseSyncing    = "syncing"
+	PhaseGenerating = "generating"
+	PhasePublishing = "publishing"
+	PhaseSucceeded  = "succeeded"
+	PhaseFailed     = "failed"
+	PhaseCanceled   = "canceled"
+)
+
+// How many builds are remembered for each site.
+var maxBuildHistory = 100
+
+// A Build is one requested run of the pipeline (sync, generate, publish)
+// for a site, along with what asked for it and how it went.
+type Build struct {
+	ID       string
+	HostName string
+	Trigger  string // "startup", "api", "add", "github", "gitlab", "gitea", "rollback", "retry"
+	Ref      string // Ref that was pushed, if triggered by a webhook
+	Commit   string // Commit SHA that was pushed, if known
+	Pusher   string // Who pushed the commit, if known
+	Rollback string `json:",omitempty"` // Release to deploy again instead of building
+	Retry    bool   `json:",omitempty"` // Only retries the failed uploads
+
+	Phase    string
+	Error    string
+	Queued   time.Time
+	Started  time.Time
+	Finished time.Time
+	Output   string // Captured output of the commands run by the build
+
+	Site SiteConf `json:"-"` // Site configuration the build runs with
+}
+
+// NewBuild returns a queued build of the site, with a fresh ID.
+func NewBuild(site SiteConf, trigger string) *Build {
+	id, _ := uuid.NewV4()
+	return &Build{
+		ID:       id.String(),
+		HostName: site.HostName,
+		Trigger:  trigger,
+		Phase:    PhaseQueued,
+		Queued:   time.Now(),
+		Site:     site,
+	}
+}
+
+// Describes the build's origin for log lines.
+func (b *Build) String() string {
+	s := fmt.Sprintf("build %s of %s [%s] via %s", b.ID, b.Site.Name, b.HostName, b.Trigger)
+	if b.Commit != "" {
+		s += fmt.Sprintf(", commit %s", b.Commit)
+	}
+	if b.Pusher != "" {
+		s += fmt.Sprintf(" pushed by %s", b.Pusher)
+	}
+	return s
+}
+
+// Returns True once the build has either succeeded, failed or been
+// canceled.
+func (b *Build) Done() bool {
+	return b.Phase == PhaseSucceeded || b.Phase == PhaseFailed || b.Phase == PhaseCanceled
+}
+
+// BuildHistory persists build records on disk, one JSON file per build
+// in a directory per site: {dir}/{hostname}/{id}.json
+type BuildHistory struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewBuildHistory(dir string) (*BuildHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BuildHistory{dir: dir}, nil
+}
+
+// Save writes the build record, replacing any previous version of it.
+func (h *BuildHistory) Save(b *Build) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sitedir := filepath.Join(h.dir, b.HostName)
+	if err := os.MkdirAll(sitedir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(sitedir, b.ID+".json"), data, 0644)
+}
+
+// Get loads the build with the given ID.
+func (h *BuildHistory) Get(id string) (*Build, error) {
+	// IDs come straight from URLs, don't let them escape the directory.
+	if id == "" || strings.ContainsAny(id, `/\.*?[`) {
+		return nil, ErrBuildNotFound
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(h.dir, "*", id+".json"))
+	if len(matches) == 0 {
+		return nil, ErrBuildNotFound
+	}
+	return readBuild(matches[0])
+}
+
+// List returns the builds of a site, most recent first.
+func (h *BuildHistory) List(hostname string) ([]*Build, error) {
+	files, err := ioutil.ReadDir(filepath.Join(h.dir, hostname))
+	if os.IsNotExist(err) {
+		return []*Build{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	builds := []*Build{}
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		b, err := readBuild(filepath.Join(h.dir, hostname, fi.Name()))
+		if err != nil {
+			continue
+		}
+		builds = append(builds, b)
+	}
+
+	sort.Sort(buildsByQueued(builds))
+	return builds, nil
+}
+
+// Prune forgets all but the most recent builds of a site.
+func (h *BuildHistory) Prune(hostname string, keep int) error {
+	builds, err := h.List(hostname)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := keep; i < len(builds); i++ {
+		if builds[i].Done() {
+			os.Remove(filepath.Join(h.dir, hostname, builds[i].ID+".json"))
+		}
+	}
+	return nil
+}
+
+func readBuild(path string) (*Build, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := Build{}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Sorts builds most recent first.
+type buildsByQueued []*Build
+
+func (s buildsByQueued) Len() int           { return len(s) }
+func (s buildsByQueued) Less(i, j int) bool { return s[i].Queued.After(s[j].Queued) }
+func (s buildsByQueued) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// buildHandler serves /builds/{id}, the record of a single build.
+func buildHandler(store SiteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		build, err := store.GetBuild(strings.Trim(strings.TrimPrefix(r.URL.Path, "/builds/"), "/"))
+		if err != nil {
+			sendResponse(w, APIResponse{
+				Code:    404,
+				Message: ErrBuildNotFound.Error(),
+			})
+			return
+		}
+
+		if err := authorizeBuild(r, store, build); err != nil {
+			authFailed(w, err)
+			return
+		}
+
+		sendResponse(w, APIResponse{
+			Code:    200,
+			Message: build.Phase,
+			Data:    build,
+		})
+	}
+}
+
+// buildsAPIHandler serves /api/builds/{id}, a build like /builds/{id}, and
+// POST /api/builds/{id}/cancel, which stops a waiting or running build.
+func buildsAPIHandler(store SiteStore, queue *BuildQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/builds/"), "/"), "/")
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "cancel") {
+			http.NotFound(w, r)
+			return
+		}
+
+		build, err := store.GetBuild(parts[0])
+		if err != nil {
+			sendResponse(w, APIResponse{
+				Code:    404,
+				Message: ErrBuildNotFound.Error(),
+			})
+			return
+		}
+		if err := authorizeBuild(r, store, build); err != nil {
+			authFailed(w, err)
+			return
+		}
+
+		if len(parts) == 1 {
+			if r.Method != "GET" {
+				methodNotAllowed(w, "GET")
+				return
+			}
+			sendResponse(w, APIResponse{
+				Code:    200,
+				Message: build.Phase,
+				Data:    build,
+			})
+			return
+		}
+
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		if err := queue.Cancel(build.ID); err == ErrBuildNotFound {
+			sendResponse(w, APIResponse{
+				Code:    409,
+				Message: "Build already finished",
+				Data:    build,
+			})
+			return
+		}
+
+		// A running build records its end by itself, shortly
+		if b, err := store.GetBuild(build.ID); err == nil {
+			build = b
+		}
+		sendResponse(w, APIResponse{
+			Code:    202,
+			Message: "Build canceled",
+			Data:    build,
+		})
+	}
+}
+
+// authorizeBuild checks that the request may see the build: it must come
+// from the admin or the site the build is of.
+func authorizeBuild(r *http.Request, store SiteStore, build *Build) error {
+	var site *SiteConf
+	if s, ok := store.Get(build.HostName); ok {
+		site = &s
+	}
+	return authorizeSiteOrAdmin(r, site)
+}
+
+// siteBuildsHandler serves /sites/{hostname}/builds, the build history of a
+// site, most recent first.
+func siteBuildsHandler(store SiteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sites/"), "/"), "/")
+		if len(parts) != 2 || parts[1] != "builds" {
+			http.NotFound(w, r)
+			return
+		}
+
+		site, ok, err := authorizeHost(r, store, parts[0], true)
+		if err != nil {
+			authFailed(w, err)
+			return
+		}
+		if !ok {
+			sendResponse(w, APIResponse{
+				Code:    404,
+				Message: "Host not found",
+			})
+			return
+		}
+
+		builds, err := store.ListBuilds(site.HostName)
+		if err != nil {
+			sendResponse(w, APIResponse{
+				Code:    500,
+				Message: err.Error(),
+			})
+			return
+		}
+
+		sendResponse(w, APIResponse{
+			Code:    200,
+			Message: fmt.Sprintf("%d builds", len(builds)),
+			Data:    builds,
+		})
+	}
+}
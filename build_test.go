@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := NewBuildHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := SiteConf{HostName: "blog.example.com"}
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		b := NewBuild(site, "api")
+		b.Queued = b.Queued.Add(time.Duration(i) * time.Second)
+		b.Phase = PhaseSucceeded
+		if err := history.Save(b); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, b.ID)
+	}
+
+	if b, err := history.Get(ids[1]); err != nil || b.ID != ids[1] || b.Phase != PhaseSucceeded {
+		t.Errorf("Expected to load build [%s] got [%v] with error [%v]", ids[1], b, err)
+	}
+	if _, err := history.Get("../" + ids[1]); err != ErrBuildNotFound {
+		t.Errorf("Expected error [%v] for a path in the build ID, got [%v]", ErrBuildNotFound, err)
+	}
+
+	builds, _ := history.List(site.HostName)
+	if len(builds) != 3 || builds[0].ID != ids[2] {
+		t.Errorf("Expected 3 builds, most recent first, got %v", builds)
+	}
+
+	history.Prune(site.HostName, 2)
+	if builds, _ := history.List(site.HostName); len(builds) != 2 {
+		t.Errorf("Expected 2 builds after pruning got %d", len(builds))
+	}
+}
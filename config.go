@@ -52,11 +52,31 @@ func parseConfig(data []byte) (Config, error) {
 }
 
 // DeployConfig represents the key-value data in the _jekyll_s3.toml file
-// used for deploying a website to Amazon's S3.
+// used for deploying a website to Amazon's S3, or to another target.
 type DeployConfig struct {
+	Type   string // "s3" (the default), "local", "sftp" or "git"
 	Key    string
 	Secret string
 	Bucket string
+	URL    string // sftp: sftp://user@host[:port]/path, git: repository URL
+	Branch string // git: branch to push to, gh-pages by default
+
+	// s3: where the bucket is, and who may read what is uploaded. Unset
+	// fields take the defaults of the [s3] section of the global config file.
+	Region    string // AWS region, or any name with Endpoint
+	Endpoint  string // URL of an S3-compatible service
+	PathStyle *bool  // Address the bucket in the path rather than the host name
+	ACL       string // Canned ACL of the uploaded files
+
+	// s3: HTTP headers of the uploaded files, see fileHeaders.
+	Headers   []HeaderRule   // Headers of the files matching globs
+	MaxAge    map[string]int // max-age of Cache-Control, by file extension
+	Immutable bool           // Cache fingerprinted files for good
+	Gzip      []string       // Extensions of the files uploaded gzipped
+
+	// s3, sftp: keep each release apart on the target and switch to it at
+	// once, see deployVersioned.
+	Releases bool
 }
 
 // ParseDeployConfig will parse a YAML file at the given path and return
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Deployer publishes the output directory of a site somewhere. Changes made
+// through it may only show once Finalize returns.
+type Deployer interface {
+	// Put deploys the file at path under key, a slash separated path.
+	Put(ctx context.Context, key, path string) error
+
+	// Delete removes what is deployed under key.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the deployed keys, along with the MD5 hash of their
+	// content in hex, or "" when it isn't known.
+	List(ctx context.Context) (map[string]string, error)
+
+	// Finalize makes the changes take effect.
+	Finalize(ctx context.Context) error
+}
+
+// A summer is a Deployer that changes files as it deploys them, like the S3
+// deployer compressing them. Sum returns the hash List gives the file at path
+// once deployed as key.
+type summer interface {
+	Sum(key, path string) (string, error)
+}
+
+// newDeployer returns the deployer for the site's deploy config. Deployers
+// running commands write their output to out.
+func newDeployer(job SiteConf, conf *DeployConfig, out io.Writer) (Deployer, error) {
+	switch conf.Type {
+	case "", "s3":
+		return newS3Deployer(job, conf)
+	case "local":
+		return newLocalDeployer(job)
+	case "sftp":
+		return newSFTPDeployer(job, conf, out)
+	case "git":
+		return newGitDeployer(job, conf, out)
+	}
+	return nil, fmt.Errorf("unsupported deploy type %q", conf.Type)
+}
+
+// Sites whose deployment matches their output directory, as far as this
+// process knows, along with where they were deployed. The others are
+// reconciled against the listing of their deployer on their next build
+// instead of being sent a changeset: after a restart, after a build that
+// didn't make it to the end of its deploy, and when the target changed.
+var deployed = struct {
+	sync.Mutex
+	sites map[string]DeployConfig
+}{sites: map[string]DeployConfig{}}
+
+// Records where the site's deployment matches its output directory, or that
+// it may not when conf is nil. Returns what was recorded before, if anything.
+func setDeployed(hostname string, conf *DeployConfig) (prev *DeployConfig) {
+	deployed.Lock()
+	defer deployed.Unlock()
+
+	if p, ok := deployed.sites[hostname]; ok {
+		prev = &p
+	}
+	if conf != nil {
+		deployed.sites[hostname] = *conf
+	} else {
+		delete(deployed.sites, hostname)
+	}
+	return prev
+}
+
+// The hash of the deploy config a site was last deployed with is kept with
+// its releases, so that changing the config, its headers for one, deploys
+// every file again even after a restart or failed deploys: the deployers'
+// listings only tell whether the content of files changed.
+const deployedFile = "deployed.sum"
+
+// Returns the hash of the deploy config.
+func deployHash(conf *DeployConfig) string {
+	data, _ := json.Marshal(conf)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns True if the site was last deployed with conf.
+func deployedWith(hostname string, conf *DeployConfig) bool {
+	data, err := ioutil.ReadFile(filepath.Join(releasesDir(hostname), deployedFile))
+	return err == nil && strings.TrimSpace(string(data)) == deployHash(conf)
+}
+
+// Records that the site was deployed with conf.
+func recordDeployed(hostname string, conf *DeployConfig) error {
+	return writeFileAtomic(filepath.Join(releasesDir(hostname), deployedFile), []byte(deployHash(conf)+"\n"), 0644)
+}
+
+// publish stores the site generated in gen as a new release of the build's
+// site, deploys what changed since the current release and makes the new
+// one current, until ctx is done. Releases that don't make it are removed.
+func publish(ctx context.Context, build *Build, gen string, out io.Writer) error {
+	job := build.Site
+	rel, dir, err := newRelease(ctx, build)
+	if err != nil {
+		return fmt.Errorf("creating release: %v", contextError(ctx, err))
+	}
+
+	changes, err := mirrorDir(ctx, gen, dir, out)
+	if err != nil {
+		err = fmt.Errorf("syncing generated site: %v", err)
+	} else {
+		fmt.Fprintf(out, "Synced generated site: %s\n", changes)
+		err = deployRelease(ctx, job, rel.ID, dir, &changes, out)
+	}
+	if err != nil {
+		removeRelease(job.HostName, rel.ID)
+		return err
+	}
+	fmt.Fprintf(out, "Released %s\n", rel.ID)
+
+	if err := pruneReleases(job.HostName, keepReleases); err != nil {
+		log.Printf("[%s] Could not remove old releases: %v", job.HostName, err)
+	}
+	return nil
+}
+
+// rollback deploys the build's release, as named by its Rollback, and makes
+// it current again, until ctx is done.
+func rollback(ctx context.Context, build *Build, out io.Writer) error {
+	job := build.Site
+	rel, dir, err := getRelease(job.HostName, build.Rollback)
+	if err != nil {
+		return fmt.Errorf("rolling back to %s: %v", build.Rollback, err)
+	}
+	build.Commit = rel.Commit
+
+	fmt.Fprintf(out, "Rolling back to release %s\n", rel.ID)
+	return deployRelease(ctx, job, rel.ID, dir, nil, out)
+}
+
+// deployRelease deploys the release of the site in dir where its deploy
+// config says, then makes it the current one. Only the changes from the
+// current release are deployed when given, if the deployment matches it;
+// the whole target is reconciled otherwise. Targets other than local ones
+// get their files replaced one by one, unless the config keeps releases
+// apart, see deployVersioned.
+func deployRelease(ctx context.Context, job SiteConf, id, dir string, changes *Changeset, out io.Writer) error {
+	conf, err := releaseDeployConfig(job, id)
+	if err != nil {
+		return fmt.Errorf("reading deployment config: %v", err)
+	}
+	d, err := newDeployer(job, conf, out)
+	if err != nil {
+		return err
+	}
+	if conf.Releases {
+		r, ok := d.(releaser)
+		if !ok {
+			return fmt.Errorf("%s deploys can't keep releases", conf.Type)
+		}
+		return deployVersioned(ctx, job, r, conf, id, dir, out)
+	}
+
+	// Deploying somewhere new, or with new settings, deploys every file
+	prev := setDeployed(job.HostName, nil)
+	inSync := prev != nil && reflect.DeepEqual(*prev, *conf)
+	force := !deployedWith(job.HostName, conf)
+
+	// Files that can't be deployed are retried later, by key
+	failed := map[string]error{}
+	done := []string{}
+	all := !inSync || force || changes == nil
+	if !all {
+		err = deployChanges(ctx, d, dir, *changes, failed, out)
+		done = append(append(append(done, changes.Added...), changes.Modified...), changes.Deleted...)
+		if err == nil {
+			var retried []string
+			retried, err = retryFailed(ctx, d, job.HostName, dir, failed, out)
+			done = append(done, retried...)
+		}
+	} else {
+		fmt.Fprintf(out, "Reconciling the deployed site\n")
+		err = reconcile(ctx, d, dir, force, failed, out)
+	}
+	if err == nil {
+		err = d.Finalize(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("deploying: %v", contextError(ctx, err))
+	}
+
+	if err := switchRelease(job.HostName, id); err != nil {
+		return fmt.Errorf("switching to release %s: %v", id, err)
+	}
+	if err := uploads.Record(job.HostName, done, failed, all); err != nil {
+		log.Printf("[%s] Could not record the failed uploads: %v", job.HostName, err)
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(out, "%d files could not be deployed and will be retried\n", len(failed))
+	}
+	if err := recordDeployed(job.HostName, conf); err != nil {
+		log.Printf("[%s] Could not record the deploy config: %v", job.HostName, err)
+	}
+	setDeployed(job.HostName, conf)
+	return nil
+}
+
+// A releaser is a Deployer keeping the releases of a site apart, and
+// switching from one to another at once. Put, Delete, List and Finalize
+// work on the release being staged, which Finalize marks complete.
+type releaser interface {
+	Deployer
+
+	// Releases returns the IDs of the complete releases, oldest first.
+	Releases(ctx context.Context) ([]string, error)
+
+	// Stage starts the release with the given ID. The files base, a
+	// complete release deployed with the same config, has the same may be
+	// copied from it rather than uploaded, when base isn't "".
+	Stage(ctx context.Context, id, base string) error
+
+	// Switch makes the complete release with the given ID the one served.
+	Switch(ctx context.Context, id string) error
+
+	// RemoveRelease removes the release with the given ID, complete or not.
+	RemoveRelease(ctx context.Context, id string) error
+}
+
+// deployVersioned deploys the release of the site in dir apart from the
+// others, unless it already is, then switches the target and the site's
+// output directory to it. Rollbacks to a release still deployed thus only
+// switch. Unlike with deployRelease, files that can't be deployed fail the
+// deploy, as the release would be served incomplete. The releases deployed
+// but no longer kept on disk are removed.
+func deployVersioned(ctx context.Context, job SiteConf, r releaser, conf *DeployConfig, id, dir string, out io.Writer) error {
+	setDeployed(job.HostName, nil)
+	ids, err := r.Releases(ctx)
+	if err != nil {
+		return fmt.Errorf("listing releases: %v", contextError(ctx, err))
+	}
+
+	if !hasRelease(ids, id) {
+		base := currentRelease(job.HostName)
+		if !hasRelease(ids, base) {
+			base = ""
+		} else if c, err := releaseDeployConfig(job, base); err != nil || !reflect.DeepEqual(*c, *conf) {
+			base = ""
+		}
+
+		fmt.Fprintf(out, "Deploying release %s\n", id)
+		failed := map[string]error{}
+		err := r.Stage(ctx, id, base)
+		if err == nil {
+			err = reconcile(ctx, r, dir, false, failed, out)
+		}
+		if err == nil && len(failed) > 0 {
+			err = fmt.Errorf("%d files could not be deployed", len(failed))
+		}
+		if err == nil {
+			err = r.Finalize(ctx)
+		}
+		if err != nil {
+			// Not on ctx, which may be what stopped the deploy
+			rctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if rerr := r.RemoveRelease(rctx, id); rerr != nil {
+				log.Printf("[%s] Could not remove the incomplete release %s: %v", job.HostName, id, rerr)
+			}
+			return fmt.Errorf("deploying: %v", contextError(ctx, err))
+		}
+		ids = append(ids, id)
+	}
+
+	if err := r.Switch(ctx, id); err != nil {
+		return fmt.Errorf("switching to release %s: %v", id, contextError(ctx, err))
+	}
+	fmt.Fprintf(out, "Switched to release %s\n", id)
+	if err := switchRelease(job.HostName, id); err != nil {
+		return fmt.Errorf("switching to release %s: %v", id, err)
+	}
+	if err := uploads.Remove(job.HostName); err != nil {
+		log.Printf("[%s] Could not remove the failed uploads: %v", job.HostName, err)
+	}
+	if err := recordDeployed(job.HostName, conf); err != nil {
+		log.Printf("[%s] Could not record the deploy config: %v", job.HostName, err)
+	}
+
+	releases, err := listReleases(job.HostName)
+	if err != nil {
+		return nil
+	}
+	kept := map[string]bool{}
+	for _, rel := range releases {
+		kept[rel.ID] = true
+	}
+	for _, old := range ids {
+		if kept[old] {
+			continue
+		}
+		if err := r.RemoveRelease(ctx, old); err != nil {
+			log.Printf("[%s] Could not remove the deployed release %s: %v", job.HostName, old, err)
+		}
+	}
+	return nil
+}
+
+// Returns True if ids holds id.
+func hasRelease(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// retryFailed retries the uploads of the site that failed before and are
+// due, but for those failed already holds, which it adds those that fail
+// again to. It returns the keys it retried.
+func retryFailed(ctx context.Context, d Deployer, hostname, dir string, failed map[string]error, out io.Writer) ([]string, error) {
+	list, err := uploads.List(hostname)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	retried := []string{}
+	for _, u := range list {
+		if _, ok := failed[u.Key]; ok || !u.due(now) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		if err := syncKey(ctx, d, dir, u.Key, out); err != nil {
+			if ctx.Err() != nil {
+				return nil, contextError(ctx, ctx.Err())
+			}
+			failed[u.Key] = err
+		}
+		retried = append(retried, u.Key)
+	}
+	return retried, nil
+}
+
+// retryUploads deploys the current release of the build's site again, which
+// retries the uploads that failed, until ctx is done. When that fails, the
+// uploads that were due count as having failed again.
+func retryUploads(ctx context.Context, build *Build, out io.Writer) error {
+	job := build.Site
+	id := currentRelease(job.HostName)
+	if id == "" {
+		fmt.Fprintf(out, "No release to retry uploads for\n")
+		return uploads.Remove(job.HostName)
+	}
+	_, dir, err := getRelease(job.HostName, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Retrying failed uploads of release %s\n", id)
+	err = deployRelease(ctx, job, id, dir, &Changeset{}, out)
+	if err != nil && ctx.Err() == nil {
+		list, _ := uploads.List(job.HostName)
+		failed := map[string]error{}
+		now := time.Now()
+		for _, u := range list {
+			if u.due(now) {
+				failed[u.Key] = err
+			}
+		}
+		uploads.Record(job.HostName, nil, failed, false)
+	}
+	return err
+}
+
+// deployConfig returns where the site is deployed: the _jekyll_s3.yml file of
+// its source if it has one, else the global S3 credentials, to a bucket
+// named after the host. Either way, S3 settings it leaves unset take the
+// global defaults.
+func deployConfig(job SiteConf) (*DeployConfig, error) {
+	checkout, _, _ := siteDirs(job.HostName)
+	return readDeployConfig(job, filepath.Join(checkout, job.SourceDir, "_jekyll_s3.yml"))
+}
+
+// releaseDeployConfig returns where the release of the site with the given
+// ID is deployed: like deployConfig, but with the _jekyll_s3.yml file saved
+// with the release. Releases made before those were saved use the file of
+// the current source.
+func releaseDeployConfig(job SiteConf, id string) (*DeployConfig, error) {
+	path := filepath.Join(releasesDir(job.HostName), id+deployConfigExt)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return deployConfig(job)
+	}
+	return readDeployConfig(job, path)
+}
+
+// Returns the deploy config of the site in the file at path, or the global
+// one if there is no such file or it is empty.
+func readDeployConfig(job SiteConf, path string) (*DeployConfig, error) {
+	conf := &DeployConfig{Key: s3key, Secret: s3secret, Bucket: job.HostName}
+	if fi, err := os.Stat(path); fi != nil && err == nil && fi.Size() > 0 {
+		if conf, err = ParseDeployConfig(path); err != nil {
+			return nil, err
+		}
+	}
+	setS3Defaults(conf)
+	return conf, nil
+}
+
+// Copies the _jekyll_s3.yml file of the build's source to path, or writes
+// an empty file there if there is none. It holds credentials, only the
+// server's user may read it.
+func saveDeployConfig(build *Build, path string) error {
+	checkout, _, _ := siteDirs(build.HostName)
+	data, err := ioutil.ReadFile(filepath.Join(checkout, build.Site.SourceDir, "_jekyll_s3.yml"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Gives the S3 settings conf leaves unset the global defaults. The default
+// endpoint only applies to configs naming neither a region nor an endpoint.
+func setS3Defaults(conf *DeployConfig) {
+	if conf.Region == "" && conf.Endpoint == "" {
+		conf.Endpoint = s3defaults.Endpoint
+	}
+	if conf.Region == "" {
+		conf.Region = s3defaults.Region
+	}
+	if conf.PathStyle == nil {
+		conf.PathStyle = s3defaults.PathStyle
+	}
+	if conf.ACL == "" {
+		conf.ACL = s3defaults.ACL
+	}
+}
+
+// deployChanges deploys the added and modified files of dir, and deletes the
+// deleted ones. Pages go last, so that what they link to is there by the time
+// they are. Files that still fail after a few tries are added to failed,
+// along with the reason, and left behind.
+func deployChanges(ctx context.Context, d Deployer, dir string, changes Changeset, failed map[string]error, out io.Writer) error {
+	b := newBatch(ctx, d, failed, out)
+	defer b.wg.Wait()
+	for _, pages := range []bool{false, true} {
+		for _, key := range append(append([]string{}, changes.Added...), changes.Modified...) {
+			if isHTMLKey(key) != pages {
+				continue
+			}
+			key := key
+			if err := b.do(key, func() error { return deployFile(ctx, d, dir, key, b.out) }); err != nil {
+				return err
+			}
+		}
+		if err := b.wait(); err != nil {
+			return err
+		}
+	}
+	for _, key := range changes.Deleted {
+		key := key
+		if err := b.do(key, func() error { return deleteKey(ctx, d, key, b.out) }); err != nil {
+			return err
+		}
+	}
+	return b.wait()
+}
+
+// reconcile makes the deployment hold the files of dir and nothing else:
+// files that aren't deployed or whose content differs are deployed, all of
+// them when force is set, pages last, and keys without a file are deleted.
+// Like with deployChanges, files that fail are added to failed.
+func reconcile(ctx context.Context, d Deployer, dir string, force bool, failed map[string]error, out io.Writer) error {
+	sums, err := d.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing: %v", err)
+	}
+
+	b := newBatch(ctx, d, failed, out)
+	defer b.wg.Wait()
+	pages := []string{}
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return contextError(ctx, err)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		sum, ok := sums[key]
+		delete(sums, key)
+		if ok && sum != "" && !force {
+			var local string
+			if s, ok := d.(summer); ok {
+				local, err = s.Sum(key, p)
+			} else {
+				local, err = md5File(p)
+			}
+			if err != nil || local == sum {
+				return err
+			}
+		}
+		if isHTMLKey(key) {
+			pages = append(pages, key)
+			return nil
+		}
+		return b.do(key, func() error { return deployFile(ctx, d, dir, key, b.out) })
+	})
+	if err == nil {
+		err = b.wait()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range pages {
+		key := key
+		if err := b.do(key, func() error { return deployFile(ctx, d, dir, key, b.out) }); err != nil {
+			return err
+		}
+	}
+	if err := b.wait(); err != nil {
+		return err
+	}
+	for key := range sums {
+		key := key
+		if err := b.do(key, func() error { return deleteKey(ctx, d, key, b.out) }); err != nil {
+			return err
+		}
+	}
+	return b.wait()
+}
+
+// A parallelDeployer is a Deployer whose Put and Delete may be called from
+// several goroutines at once.
+type parallelDeployer interface {
+	Deployer
+	parallel()
+}
+
+// A batch runs the operations of a deploy, several at once when the
+// deployer allows, as many as the upload pool has slots, and records the
+// keys that fail. It writes the output of the operations to out.
+type batch struct {
+	ctx    context.Context
+	failed map[string]error
+	out    io.Writer
+	slots  chan struct{} // Nil when operations run one at a time
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+}
+
+func newBatch(ctx context.Context, d Deployer, failed map[string]error, out io.Writer) *batch {
+	b := &batch{ctx: ctx, failed: failed, out: out}
+	if _, ok := d.(parallelDeployer); ok {
+		b.slots = make(chan struct{}, uploaders.size)
+		b.out = &lockedWriter{w: out}
+	}
+	return b
+}
+
+// do runs op for key, or starts it, and records its failure. It returns an
+// error once ctx is done, as the deploy must stop.
+func (b *batch) do(key string, op func() error) error {
+	if err := b.ctx.Err(); err != nil {
+		return contextError(b.ctx, err)
+	}
+	if b.slots == nil {
+		b.record(key, op())
+		return nil
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+	case <-b.ctx.Done():
+		return contextError(b.ctx, b.ctx.Err())
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.slots }()
+		b.record(key, op())
+	}()
+	return nil
+}
+
+func (b *batch) record(key string, err error) {
+	if err == nil || b.ctx.Err() != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed[key] = err
+}
+
+// wait waits for the operations started to end. It returns an error if ctx
+// is done.
+func (b *batch) wait() error {
+	b.wg.Wait()
+	if err := b.ctx.Err(); err != nil {
+		return contextError(b.ctx, err)
+	}
+	return nil
+}
+
+// How many times an operation of a deploy is tried before it is left for
+// later, and how long to wait before trying it again the first time. The
+// wait doubles after each attempt.
+var (
+	deployAttempts   = 3
+	deployRetryDelay = 500 * time.Millisecond
+)
+
+// Calls f until it succeeds, at most deployAttempts times, or until ctx is
+// done, as remote storage has hiccups.
+func withRetries(ctx context.Context, f func() error) error {
+	delay := deployRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= deployAttempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Deploys the file of dir at the slash separated path key.
+func deployFile(ctx context.Context, d Deployer, dir, key string, out io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if err := withRetries(ctx, func() error { return d.Put(ctx, key, path) }); err != nil {
+		fmt.Fprintf(out, "Could not deploy %s: %v\n", key, err)
+		return fmt.Errorf("deploying %s: %v", key, err)
+	}
+	fmt.Fprintf(out, "Deployed %s\n", key)
+	return nil
+}
+
+// Deploys the file of dir at key, or deletes key when dir doesn't have it.
+func syncKey(ctx context.Context, d Deployer, dir, key string, out io.Writer) error {
+	fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key)))
+	if err == nil && fi.Mode().IsRegular() {
+		return deployFile(ctx, d, dir, key, out)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteKey(ctx, d, key, out)
+}
+
+// Returns True if the file deployed as key is an HTML page.
+func isHTMLKey(key string) bool {
+	ext := path.Ext(key)
+	return ext == ".html" || ext == ".htm"
+}
+
+func deleteKey(ctx context.Context, d Deployer, key string, out io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := withRetries(ctx, func() error { return d.Delete(ctx, key) }); err != nil {
+		fmt.Fprintf(out, "Could not delete %s: %v\n", key, err)
+		return fmt.Errorf("deleting %s: %v", key, err)
+	}
+	fmt.Fprintf(out, "Deleted %s\n", key)
+	return nil
+}
+
+// localDeployer copies sites into a directory of the server, for serving
+// them with another web server: the directory named after the host under the
+// deploy root, set by local_root in the [deploy] section of the global
+// config file. Without it, local deploys are disabled.
+//
+// That directory is a symbolic link to a timestamped copy of the site in
+// the .releases directory of the deploy root. Changes are made to a new
+// copy, hard linked to the current one, and Finalize switches the link to
+// it, so the web server serves either the old site or the new one.
+type localDeployer struct {
+	link     string // The directory the site is served from
+	releases string // Where the copies are
+	dir      string // The new copy, once a change was made
+}
+
+func newLocalDeployer(job SiteConf) (*localDeployer, error) {
+	if deployroot == "" {
+		return nil, fmt.Errorf("local deploys are not enabled")
+	}
+	return &localDeployer{
+		link:     filepath.Join(deployroot, job.HostName),
+		releases: filepath.Join(deployroot, ".releases", job.HostName),
+	}, nil
+}
+
+// Returns the copy changes are made to, making it on the first change.
+func (d *localDeployer) stage(ctx context.Context) (string, error) {
+	if d.dir == "" {
+		id, err := stageRelease(ctx, d.releases, d.link)
+		if err != nil {
+			return "", err
+		}
+		d.dir = filepath.Join(d.releases, id)
+	}
+	return d.dir, nil
+}
+
+func (d *localDeployer) Put(ctx context.Context, key, path string) error {
+	dir, err := d.stage(ctx)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, dest, fi.Mode().Perm())
+}
+
+// Delete removes the file, and the directories it leaves empty.
+func (d *localDeployer) Delete(ctx context.Context, key string) error {
+	dir, err := d.stage(ctx)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, filepath.FromSlash(key))
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for p := filepath.Dir(dest); p != dir; p = filepath.Dir(p) {
+		if os.Remove(p) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// List lists the copy being made, or the one served.
+func (d *localDeployer) List(ctx context.Context) (map[string]string, error) {
+	if d.dir != "" {
+		return listDir(ctx, d.dir, nil)
+	}
+	if id := linkedRelease(d.link); id != "" {
+		return listDir(ctx, filepath.Join(d.releases, id), nil)
+	}
+	return listDir(ctx, d.link, nil)
+}
+
+// Finalize serves the new copy, if any, and removes the old ones but for
+// the most recent.
+func (d *localDeployer) Finalize(ctx context.Context) error {
+	if d.dir == "" {
+		return nil
+	}
+	if err := switchLink(d.link, d.dir); err != nil {
+		return err
+	}
+	d.dir = ""
+	for _, id := range oldReleases(d.releases, linkedRelease(d.link), keepReleases) {
+		if err := os.RemoveAll(filepath.Join(d.releases, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the files under dir and the MD5 hash of their content, by slash
+// separated path. Paths for which skip returns True are left out, along with
+// what is under them.
+func listDir(ctx context.Context, dir string, skip func(rel string) bool) (map[string]string, error) {
+	sums := map[string]string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if skip != nil && skip(key) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		sums[key], err = md5File(p)
+		return err
+	})
+	return sums, err
+}
+
+// Returns the MD5 hash of the file's content, in hex.
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
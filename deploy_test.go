@@ -0,0 +1,858 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memBucket is a bucket kept in memory, listing one key at a time to
+// exercise paging.
+type memBucket struct {
+	sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+	puts    []string
+	copies  []string
+	fail    map[string]bool // Keys failing to upload
+	parts   map[string]int  // Parts of the multipart uploads, by key
+	website string          // Website configuration
+}
+
+func (b *memBucket) PutReaderHeader(path string, r io.Reader, length int64, customHeaders map[string][]string, perm s3.ACL) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	} else if int64(len(data)) != length {
+		return fmt.Errorf("%s is %d bytes long, not %d", path, len(data), length)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.fail[path] {
+		return errors.New("upload failed")
+	}
+	if src := http.Header(customHeaders).Get("X-Amz-Copy-Source"); src != "" {
+		key, _ := url.PathUnescape(strings.SplitN(src, "/", 3)[2])
+		b.objects[path] = b.objects[key]
+		b.copies = append(b.copies, path)
+		return nil
+	}
+	b.objects[path] = data
+	if b.headers != nil {
+		b.headers[path] = customHeaders
+	}
+	b.puts = append(b.puts, path)
+	return nil
+}
+
+func (b *memBucket) initMulti(key string, header http.Header, perm s3.ACL) (multiUpload, error) {
+	return &memMulti{b: b, key: key, header: header}, nil
+}
+
+func (b *memBucket) Del(path string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.objects, path)
+	return nil
+}
+
+func (b *memBucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	b.Lock()
+	defer b.Unlock()
+	entries := map[string]bool{}
+	for k := range b.objects {
+		if !strings.HasPrefix(k, prefix) || k <= marker || (delim != "" && strings.HasSuffix(marker, delim) && strings.HasPrefix(k, marker)) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delim); delim != "" && i >= 0 {
+			k = k[:len(prefix)+i+len(delim)]
+		}
+		entries[k] = true
+	}
+	keys := []string{}
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resp := &s3.ListResp{IsTruncated: len(keys) > 1}
+	if len(keys) == 0 {
+		return resp, nil
+	}
+	resp.NextMarker = keys[0]
+	if _, ok := b.objects[keys[0]]; !ok {
+		resp.CommonPrefixes = []string{keys[0]}
+		return resp, nil
+	}
+	sum := md5.Sum(b.objects[keys[0]])
+	etag := hex.EncodeToString(sum[:])
+	if n := b.parts[keys[0]]; n > 0 {
+		etag = multipartETag(b.objects[keys[0]], n)
+	}
+	resp.Contents = []s3.Key{{Key: keys[0], ETag: `"` + etag + `"`}}
+	return resp, nil
+}
+
+func (b *memBucket) putWebsite(config []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	b.website = string(config)
+	return nil
+}
+
+// Returns the ETag S3 gives objects uploaded in parts of multipartSize.
+func multipartETag(data []byte, n int) string {
+	sums := md5.New()
+	for len(data) > 0 {
+		part := data
+		if int64(len(part)) > multipartSize {
+			part = part[:multipartSize]
+		}
+		sum := md5.Sum(part)
+		sums.Write(sum[:])
+		data = data[len(part):]
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), n)
+}
+
+// memMulti is a multipart upload to a memBucket.
+type memMulti struct {
+	b      *memBucket
+	key    string
+	header http.Header
+	buf    []byte
+	n      int
+}
+
+func (m *memMulti) PutAll(r s3.ReaderAtSeeker, partSize int64) ([]s3.Part, error) {
+	parts := []s3.Part{}
+	for {
+		part := make([]byte, partSize)
+		n, err := io.ReadFull(r, part)
+		if n > 0 {
+			m.buf = append(m.buf, part[:n]...)
+			parts = append(parts, s3.Part{N: len(parts) + 1, Size: int64(n)})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return parts, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (m *memMulti) Complete(parts []s3.Part) error {
+	m.b.Lock()
+	defer m.b.Unlock()
+	m.b.objects[m.key] = m.buf
+	if m.b.headers != nil {
+		m.b.headers[m.key] = m.header
+	}
+	if m.b.parts == nil {
+		m.b.parts = map[string]int{}
+	}
+	m.b.parts[m.key] = len(parts)
+	m.b.puts = append(m.b.puts, m.key)
+	return nil
+}
+
+func (m *memMulti) Abort() error {
+	return nil
+}
+
+func (b *memBucket) keys() []string {
+	keys := []string{}
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Checks that the deployer lists exactly files, by key and content.
+func checkDeployed(t *testing.T, d Deployer, files map[string]string) {
+	sums, err := d.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for key, content := range files {
+		sum := md5.Sum([]byte(content))
+		want[key] = hex.EncodeToString(sum[:])
+	}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("Expected %v deployed got %v", want, sums)
+	}
+}
+
+// Deploys dir with d, reconciling first then through a changeset, and
+// checks the result.
+func testDeployer(t *testing.T, d Deployer, dir string) {
+	writeFiles(t, dir, map[string]string{
+		"index.html":      "home",
+		"about.html":      "about",
+		"blog/hello.html": "hello",
+	})
+	failed := map[string]error{}
+	if err := reconcile(context.Background(), d, dir, false, failed, ioutil.Discard); err != nil || len(failed) > 0 {
+		t.Fatal(err, failed)
+	}
+	if err := d.Finalize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkDeployed(t, d, map[string]string{"index.html": "home", "about.html": "about", "blog/hello.html": "hello"})
+
+	writeFiles(t, dir, map[string]string{"index.html": "HOME"})
+	os.RemoveAll(filepath.Join(dir, "blog"))
+	changes := Changeset{Modified: []string{"index.html"}, Deleted: []string{"blog/hello.html"}}
+	if err := deployChanges(context.Background(), d, dir, changes, failed, ioutil.Discard); err != nil || len(failed) > 0 {
+		t.Fatal(err, failed)
+	}
+	if err := d.Finalize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkDeployed(t, d, map[string]string{"index.html": "HOME", "about.html": "about"})
+}
+
+func TestS3Deployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &memBucket{objects: map[string][]byte{
+		"index.html": []byte("home"),
+		"stale.html": []byte("stale"),
+	}}
+	testDeployer(t, &s3Deployer{b: b, conf: &DeployConfig{}}, dir)
+
+	// The unchanged file was left alone
+	sort.Strings(b.puts)
+	if want := []string{"about.html", "blog/hello.html", "index.html"}; !reflect.DeepEqual(b.puts, want) {
+		t.Errorf("Expected uploads %v got %v", want, b.puts)
+	}
+}
+
+func TestS3DeployerHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"app.css":        "body {}",
+		"old/index.html": string(redirectPage("/new/")),
+	})
+	b := &memBucket{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	d := &s3Deployer{b: b, conf: &DeployConfig{Gzip: []string{"css"}, MaxAge: map[string]int{"css": 600}}}
+	if err := reconcile(context.Background(), d, dir, false, map[string]error{}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	h := b.headers["app.css"]
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Cache-Control") != "public, max-age=600" {
+		t.Errorf("Expected app.css to be gzipped and cached got %v", h)
+	}
+	if loc := b.headers["old/index.html"].Get("X-Amz-Website-Redirect-Location"); loc != "/new/" {
+		t.Errorf("Expected a redirect to /new/ got [%s]", loc)
+	}
+
+	// The gzipped file is seen as up to date
+	b.puts = nil
+	if err := reconcile(context.Background(), d, dir, false, map[string]error{}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.puts) != 0 {
+		t.Errorf("Expected no uploads got %v", b.puts)
+	}
+}
+
+func TestDeployFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(delay time.Duration) { deployRetryDelay = delay }(deployRetryDelay)
+	deployRetryDelay = time.Millisecond
+
+	writeFiles(t, dir, map[string]string{"index.html": "home", "big.pdf": "pdf", "app.css": "css"})
+	b := &memBucket{objects: map[string][]byte{}, fail: map[string]bool{"big.pdf": true}}
+	d := &s3Deployer{b: b, conf: &DeployConfig{}}
+	changes := Changeset{Added: []string{"app.css", "big.pdf", "index.html"}}
+	failed := map[string]error{}
+	if err := deployChanges(context.Background(), d, dir, changes, failed, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other files made it, the pages last
+	if len(failed) != 1 || failed["big.pdf"] == nil {
+		t.Errorf("Expected big.pdf to fail got %v", failed)
+	}
+	if want := []string{"app.css", "index.html"}; !reflect.DeepEqual(b.puts, want) {
+		t.Errorf("Expected uploads %v got %v", want, b.puts)
+	}
+
+	// Builds only retry the failed uploads that are due
+	defer func(q *UploadQueue) { uploads = q }(uploads)
+	if uploads, err = NewUploadQueue(filepath.Join(dir, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+	uploads.Record("example.com", nil, failed, false)
+	retried, err := retryFailed(context.Background(), d, "example.com", dir, map[string]error{}, ioutil.Discard)
+	if err != nil || len(retried) != 0 {
+		t.Errorf("Expected no retry before the backoff got %v (%v)", retried, err)
+	}
+	list, _ := uploads.List("example.com")
+	list[0].Next = time.Now()
+	uploads.save("example.com", list)
+	retried, err = retryFailed(context.Background(), d, "example.com", dir, map[string]error{}, ioutil.Discard)
+	if err != nil || len(retried) != 1 || retried[0] != "big.pdf" {
+		t.Errorf("Expected big.pdf to be retried got %v (%v)", retried, err)
+	}
+}
+
+func TestS3DeployerMultipart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(threshold, size int64) { multipartThreshold, multipartSize = threshold, size }(multipartThreshold, multipartSize)
+	multipartThreshold, multipartSize = 10, 4
+
+	writeFiles(t, dir, map[string]string{
+		"video.mp4": "0123456789abcdef",
+		"small.txt": "0123",
+		"page.html": "0123456789abcdef",
+	})
+	b := &memBucket{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	d := &s3Deployer{b: b, conf: &DeployConfig{MaxAge: map[string]int{"html": 60}}}
+	if err := reconcile(context.Background(), d, dir, false, map[string]error{}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large files go in parts, with their headers
+	if want := map[string]int{"video.mp4": 4, "page.html": 4}; !reflect.DeepEqual(b.parts, want) {
+		t.Errorf("Expected the parts %v got %v", want, b.parts)
+	}
+	if got := b.headers["page.html"].Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Expected the page to be sent with its Cache-Control got [%s]", got)
+	}
+	if string(b.objects["video.mp4"]) != "0123456789abcdef" {
+		t.Errorf("Expected the video to be uploaded whole got [%s]", b.objects["video.mp4"])
+	}
+
+	// The ETags of multipart uploads are matched
+	b.puts = nil
+	if err := reconcile(context.Background(), d, dir, false, map[string]error{}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.puts) != 0 {
+		t.Errorf("Expected no uploads got %v", b.puts)
+	}
+}
+
+func TestS3Region(t *testing.T) {
+	pathStyle := true
+	tests := []struct {
+		conf              DeployConfig
+		endpoint, buckets string
+	}{
+		{DeployConfig{Region: "us-east-1", Bucket: "site"}, "https://s3.amazonaws.com", "https://${bucket}.s3.amazonaws.com"},
+		{DeployConfig{Region: "us-east-1", Bucket: "example.com"}, "https://s3.amazonaws.com", ""},
+		{DeployConfig{Endpoint: "http://localhost:9000/", Bucket: "site", PathStyle: &pathStyle}, "http://localhost:9000", ""},
+		{DeployConfig{Endpoint: "https://s3.wasabisys.com", Bucket: "site"}, "https://s3.wasabisys.com", "https://${bucket}.s3.wasabisys.com"},
+	}
+	for _, test := range tests {
+		region, err := s3Region(&test.conf)
+		if err != nil {
+			t.Errorf("Expected %+v to be valid got %v", test.conf, err)
+			continue
+		}
+		if region.S3Endpoint != test.endpoint || region.S3BucketEndpoint != test.buckets {
+			t.Errorf("Expected [%s %s] got [%s %s]", test.endpoint, test.buckets, region.S3Endpoint, region.S3BucketEndpoint)
+		}
+	}
+
+	for _, conf := range []DeployConfig{{Region: "mars-1"}, {Endpoint: "ftp://example.com"}, {Endpoint: "https://example.com/path"}} {
+		if _, err := s3Region(&conf); err == nil {
+			t.Errorf("Expected %+v to be rejected", conf)
+		}
+	}
+	if _, err := s3ACL("public"); err == nil {
+		t.Errorf("Expected an unknown ACL to be rejected")
+	}
+}
+
+func TestS3Signature(t *testing.T) {
+	// The example of Amazon's documentation
+	header := http.Header{"Date": {"Tue, 27 Mar 2007 19:36:42 +0000"}}
+	sig := s3Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "GET", "/johnsmith/photos/puppy.jpg", header)
+	if sig != "bWq2s1WEIj+Ydj0vQ697zp+IXMU=" {
+		t.Errorf("Expected [bWq2s1WEIj+Ydj0vQ697zp+IXMU=] got [%s]", sig)
+	}
+}
+
+func TestS3InitMulti(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>site</Bucket><Key>a b.html</Key><UploadId>abc</UploadId></InitiateMultipartUploadResult>`))
+	}))
+	defer server.Close()
+
+	auth := aws.Auth{AccessKey: "key", SecretKey: "secret"}
+	b := s3Bucket{s3.New(auth, aws.Region{S3Endpoint: server.URL}).Bucket("site")}
+	header := http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"public, max-age=60"}}
+	m, err := b.initMulti("a b.html", header, s3.PublicRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multi, ok := m.(*s3.Multi); !ok || multi.UploadId != "abc" || multi.Key != "a b.html" {
+		t.Errorf("Expected the upload [abc] of [a b.html] got %+v", m)
+	}
+
+	if got.Method != "POST" || got.URL.RequestURI() != "/site/a%20b.html?uploads" {
+		t.Errorf("Expected POST /site/a%%20b.html?uploads got %s %s", got.Method, got.URL.RequestURI())
+	}
+	for name, value := range map[string]string{"Cache-Control": "public, max-age=60", "Content-Type": "text/html", "X-Amz-Acl": "public-read"} {
+		if got.Header.Get(name) != value {
+			t.Errorf("Expected %s [%s] got [%s]", name, value, got.Header.Get(name))
+		}
+	}
+	sig := s3Signature("secret", "POST", "/site/a%20b.html?uploads", got.Header)
+	if want := "AWS key:" + sig; got.Header.Get("Authorization") != want {
+		t.Errorf("Expected Authorization [%s] got [%s]", want, got.Header.Get("Authorization"))
+	}
+}
+
+func TestS3Defaults(t *testing.T) {
+	defer func(defaults DeployConfig) { s3defaults = defaults }(s3defaults)
+	yes, no := true, false
+	s3defaults = DeployConfig{Region: "eu", Endpoint: "https://s3.example.com", PathStyle: &yes, ACL: "private"}
+
+	tests := []struct {
+		conf, want DeployConfig
+	}{
+		{DeployConfig{}, DeployConfig{Region: "eu", Endpoint: "https://s3.example.com", PathStyle: &yes, ACL: "private"}},
+		{DeployConfig{Region: "us-west-2"}, DeployConfig{Region: "us-west-2", PathStyle: &yes, ACL: "private"}},
+		{DeployConfig{Endpoint: "https://minio.example.com"}, DeployConfig{Region: "eu", Endpoint: "https://minio.example.com", PathStyle: &yes, ACL: "private"}},
+		{DeployConfig{PathStyle: &no, ACL: "public-read"}, DeployConfig{Region: "eu", Endpoint: "https://s3.example.com", PathStyle: &no, ACL: "public-read"}},
+	}
+	for _, test := range tests {
+		conf := test.conf
+		setS3Defaults(&conf)
+		if !reflect.DeepEqual(conf, test.want) {
+			t.Errorf("Expected %+v got %+v", test.want, conf)
+		}
+	}
+}
+
+func TestLocalDeployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { deployroot = root }(deployroot)
+	deployroot = ""
+	if _, err := newLocalDeployer(SiteConf{HostName: "example.com"}); err == nil {
+		t.Errorf("Expected local deploys to be disabled without a deploy root")
+	}
+
+	deployroot = filepath.Join(dir, "www")
+	writeFiles(t, filepath.Join(deployroot, "example.com"), map[string]string{"stale/old.html": "old"})
+	d, err := newLocalDeployer(SiteConf{HostName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDeployer(t, d, filepath.Join(dir, "out"))
+
+	if _, err := os.Stat(filepath.Join(deployroot, "example.com", "blog")); !os.IsNotExist(err) {
+		t.Errorf("Expected the emptied directory to be removed got %v", err)
+	}
+	if linkedRelease(filepath.Join(deployroot, "example.com")) == "" {
+		t.Errorf("Expected the site to be served from a release")
+	}
+}
+
+func TestGitDeployer(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := filepath.Join(dir, "pages.git")
+	testGit(t, "", "init", "-q", "--bare", remote)
+
+	d := &gitDeployer{
+		job:    SiteConf{HostName: "example.com"},
+		url:    remote,
+		branch: "gh-pages",
+		dir:    filepath.Join(dir, "deploy"),
+		out:    ioutil.Discard,
+	}
+	testDeployer(t, d, filepath.Join(dir, "out"))
+
+	files := testGit(t, remote, "ls-tree", "-r", "--name-only", "gh-pages")
+	if want := ".nojekyll\nabout.html\nindex.html"; files != want {
+		t.Errorf("Expected the branch to hold [%s] got [%s]", want, files)
+	}
+	if n := testGit(t, remote, "rev-list", "--count", "gh-pages"); n != "2" {
+		t.Errorf("Expected 2 commits got %s", n)
+	}
+
+	// A fresh deployer picks up the branch, and commits nothing new
+	d = &gitDeployer{job: d.job, url: d.url, branch: d.branch, dir: d.dir, out: ioutil.Discard}
+	checkDeployed(t, d, map[string]string{"index.html": "HOME", "about.html": "about"})
+	if err := d.Finalize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := testGit(t, remote, "rev-list", "--count", "gh-pages"); n != "2" {
+		t.Errorf("Expected 2 commits got %s", n)
+	}
+}
+
+func TestSFTPDeployerURL(t *testing.T) {
+	tests := map[string]string{
+		"sftp://deploy@example.com/var/www/site": "deploy@example.com /var/www/site",
+		"sftp://example.com:2222/~/www":          "example.com www",
+		"sftp://example.com/~":                   "example.com ",
+	}
+	for u, want := range tests {
+		d, err := newSFTPDeployer(SiteConf{}, &DeployConfig{URL: u}, ioutil.Discard)
+		if err != nil {
+			t.Errorf("Expected %s to be valid got %v", u, err)
+			continue
+		}
+		if got := d.target + " " + d.dir; got != want {
+			t.Errorf("Expected %s to give [%s] got [%s]", u, want, got)
+		}
+	}
+	for _, u := range []string{"https://example.com/", "sftp:///var/www", "sftp://-oProxyCommand=x/"} {
+		if _, err := newSFTPDeployer(SiteConf{}, &DeployConfig{URL: u}, ioutil.Discard); err == nil {
+			t.Errorf("Expected %s to be rejected", u)
+		}
+	}
+}
+
+func TestSFTPDeployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"new/sub/x.css": "x", "y.css": "y"})
+
+	d, err := newSFTPDeployer(SiteConf{}, &DeployConfig{URL: "sftp://deploy@example.com/var/www"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches [][]string
+	manifest := "1 old/a.html\n2 old/deep/b.html\n3 keep/c.html\n4 keep/d.html\n"
+	d.run = func(ctx context.Context, batch []string) error {
+		batches = append(batches, batch)
+		// The manifest is fetched to, and sent from, a local file
+		local := strings.Split(batch[len(batch)-1], `"`)
+		if strings.HasPrefix(batch[0], "-get ") {
+			return ioutil.WriteFile(local[3], []byte(manifest), 0644)
+		}
+		b, err := ioutil.ReadFile(local[1])
+		manifest = string(b)
+		return err
+	}
+
+	ctx := context.Background()
+	x, y := filepath.Join(dir, "new", "sub", "x.css"), filepath.Join(dir, "y.css")
+	d.Put(ctx, "new/sub/x.css", x)
+	d.Put(ctx, "y.css", y)
+	for _, key := range []string{"old/a.html", "old/deep/b.html", "keep/c.html"} {
+		d.Delete(ctx, key)
+	}
+	if err := d.Finalize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 2 {
+		t.Fatalf("Expected the manifest to be fetched then one batch got %v", batches)
+	}
+	batch := batches[1]
+	want := []string{
+		`-mkdir "/var/www"`,
+		`-mkdir "/var/www/new"`,
+		`-mkdir "/var/www/new/sub"`,
+		`put "` + x + `" "/var/www/new/sub/x.css"`,
+		`put "` + y + `" "/var/www/y.css"`,
+		`-rm "/var/www/old/a.html"`,
+		`-rm "/var/www/old/deep/b.html"`,
+		`-rm "/var/www/keep/c.html"`,
+		`-rmdir "/var/www/old/deep"`,
+		`-rmdir "/var/www/old"`,
+	}
+	if !reflect.DeepEqual(batch[:len(batch)-1], want) || !strings.HasSuffix(batch[len(batch)-1], `" "/var/www/.jkl-baas-manifest"`) {
+		t.Errorf("Expected the batch %v got %v", want, batch)
+	}
+
+	sx, _ := md5File(x)
+	sy, _ := md5File(y)
+	if want := "4 keep/d.html\n" + sx + " new/sub/x.css\n" + sy + " y.css\n"; manifest != want {
+		t.Errorf("Expected the manifest [%s] got [%s]", want, manifest)
+	}
+
+	// Nothing left to send
+	if err := d.Finalize(ctx); err != nil || len(batches) != 2 {
+		t.Errorf("Expected no other batch got %v (%v)", batches[2:], err)
+	}
+}
+
+func TestDeployedWith(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+	os.MkdirAll(releasesDir("example.com"), 0755)
+
+	conf := &DeployConfig{Type: "s3", Bucket: "site", MaxAge: map[string]int{"html": 60}}
+	if deployedWith("example.com", conf) {
+		t.Errorf("Expected a site never deployed not to be deployed with %+v", conf)
+	}
+	if err := recordDeployed("example.com", conf); err != nil {
+		t.Fatal(err)
+	}
+	same := *conf
+	same.MaxAge = map[string]int{"html": 60}
+	if !deployedWith("example.com", &same) {
+		t.Errorf("Expected the site to be deployed with %+v", same)
+	}
+
+	// New headers need every file deployed again
+	changed := same
+	changed.MaxAge = map[string]int{"html": 300}
+	if deployedWith("example.com", &changed) {
+		t.Errorf("Expected the site not to be deployed with %+v", changed)
+	}
+}
+
+func TestVersionedS3Deploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+	defer func(q *UploadQueue) { uploads = q }(uploads)
+	if uploads, err = NewUploadQueue(filepath.Join(dir, "uploads")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	job := SiteConf{HostName: "example.com"}
+	b := &memBucket{objects: map[string][]byte{
+		"stale.html":   []byte("stale"),
+		"old/old.html": []byte("old"),
+	}}
+	release := func(files map[string]string) (string, string) {
+		rel, path, err := newRelease(ctx, &Build{ID: "b", HostName: job.HostName, Site: job})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen := filepath.Join(dir, "gen", rel.ID)
+		writeFiles(t, gen, files)
+		if _, err := mirrorDir(ctx, gen, path, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		return rel.ID, path
+	}
+	deploy := func(id, path string) *s3Deployer {
+		conf, err := releaseDeployConfig(job, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &s3Deployer{b: b, conf: conf, site: job.HostName}
+		if err := deployVersioned(ctx, job, d, conf, id, path, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if cur := currentRelease(job.HostName); cur != id {
+			t.Errorf("Expected the current release to be %s got %s", id, cur)
+		}
+		return d
+	}
+
+	r1, dir1 := release(map[string]string{"index.html": "home", "about.html": "about", "404.html": "lost"})
+	d := deploy(r1, dir1)
+	if !strings.Contains(b.website, "<ReplaceKeyPrefixWith>_releases/"+r1+"/<") || !strings.Contains(b.website, "<ReplaceKeyWith>_releases/"+r1+"/404.html<") {
+		t.Errorf("Expected the website to serve %s got %s", r1, b.website)
+	}
+	for _, key := range []string{"stale.html", "old/old.html"} {
+		if _, ok := b.objects[key]; ok {
+			t.Errorf("Expected %s, left by deploys without releases, to be removed", key)
+		}
+	}
+
+	// Unchanged files are copied from the current release
+	b.puts, b.copies = nil, nil
+	r2, dir2 := release(map[string]string{"index.html": "home", "about.html": "ABOUT", "404.html": "lost"})
+	deploy(r2, dir2)
+	if want := []string{"_releases/" + r2 + "/about.html", "_releases/" + r2 + ".complete"}; !reflect.DeepEqual(b.puts, want) {
+		t.Errorf("Expected uploads %v got %v", want, b.puts)
+	}
+	if len(b.copies) != 2 || string(b.objects["_releases/"+r2+"/index.html"]) != "home" {
+		t.Errorf("Expected the unchanged files to be copied got %v", b.copies)
+	}
+	if ids, err := d.Releases(ctx); err != nil || !reflect.DeepEqual(ids, []string{r1, r2}) {
+		t.Errorf("Expected the releases %v got %v (%v)", []string{r1, r2}, ids, err)
+	}
+
+	// Rolling back only switches, and releases gone from disk go
+	b.puts, b.copies = nil, nil
+	if err := removeRelease(job.HostName, r2); err != nil {
+		t.Fatal(err)
+	}
+	deploy(r1, dir1)
+	if len(b.puts) != 0 || len(b.copies) != 0 || !strings.Contains(b.website, "_releases/"+r1+"/<") {
+		t.Errorf("Expected only a switch to %s got %v %v", r1, b.puts, b.copies)
+	}
+	for key := range b.objects {
+		if strings.HasPrefix(key, "_releases/"+r2) {
+			t.Errorf("Expected %s to be removed with its release", key)
+		}
+	}
+}
+
+// fakeSFTP is a remote file system for sftp batches.
+type fakeSFTP struct {
+	files map[string]string // Content of the files, by path
+	links map[string]string // Target of the symbolic links, by path
+	runs  [][]string
+}
+
+var sftpCommand = regexp.MustCompile(`^-?(\w+)(?: -s)?((?: "[^"]*")*)$`)
+
+func (f *fakeSFTP) run(ctx context.Context, batch []string) error {
+	f.runs = append(f.runs, batch)
+	for _, line := range batch {
+		m := sftpCommand.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("bad command %s", line)
+		}
+		args := strings.Split(strings.Trim(strings.TrimSpace(m[2]), `"`), `" "`)
+		switch {
+		case m[1] == "get":
+			if content, ok := f.files[args[0]]; ok {
+				ioutil.WriteFile(args[1], []byte(content), 0644)
+			}
+		case m[1] == "put":
+			data, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			f.files[args[1]] = string(data)
+		case m[1] == "ln" && strings.Contains(line, " -s "):
+			f.links[args[1]] = args[0]
+		case m[1] == "ln":
+			f.files[args[1]] = f.files[args[0]]
+		case m[1] == "rename":
+			f.links[args[1]] = f.links[args[0]]
+			delete(f.links, args[0])
+		case m[1] == "rm":
+			delete(f.files, args[0])
+			delete(f.links, args[0])
+		}
+	}
+	return nil
+}
+
+func TestVersionedSFTPDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := newSFTPDeployer(SiteConf{}, &DeployConfig{URL: "sftp://deploy@example.com/var/www"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &fakeSFTP{files: map[string]string{}, links: map[string]string{}}
+	d.run = remote.run
+
+	ctx := context.Background()
+	r1, r2 := "20261016T120000Z", "20261016T130000Z"
+	stage := func(id, base string, files map[string]string) {
+		path := filepath.Join(dir, id)
+		writeFiles(t, path, files)
+		if err := d.Stage(ctx, id, base); err != nil {
+			t.Fatal(err)
+		}
+		failed := map[string]error{}
+		if err := reconcile(ctx, d, path, false, failed, ioutil.Discard); err != nil || len(failed) > 0 {
+			t.Fatal(err, failed)
+		}
+		if err := d.Finalize(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stage(r1, "", map[string]string{"index.html": "home", "blog/a.html": "a"})
+	if err := d.Switch(ctx, r1); err != nil {
+		t.Fatal(err)
+	}
+	if target := remote.links["/var/www/current"]; target != ".releases/"+r1 {
+		t.Errorf("Expected current to point at .releases/%s got [%s]", r1, target)
+	}
+
+	// Unchanged files are linked to those of the base release
+	stage(r2, r1, map[string]string{"index.html": "HOME", "blog/a.html": "a"})
+	batch := strings.Join(remote.runs[len(remote.runs)-1], "\n")
+	link := `ln "/var/www/.releases/` + r1 + `/blog/a.html" "/var/www/.releases/` + r2 + `/blog/a.html"`
+	if !strings.Contains(batch, link) || remote.files["/var/www/.releases/"+r2+"/index.html"] != "HOME" {
+		t.Errorf("Expected a link to the unchanged file and the changed one put got %s", batch)
+	}
+	if ids, err := d.Releases(ctx); err != nil || !reflect.DeepEqual(ids, []string{r1, r2}) {
+		t.Errorf("Expected the releases %v got %v (%v)", []string{r1, r2}, ids, err)
+	}
+
+	if err := d.RemoveRelease(ctx, r1); err != nil {
+		t.Fatal(err)
+	}
+	for path := range remote.files {
+		if strings.Contains(path, r1) {
+			t.Errorf("Expected %s to be removed with its release", path)
+		}
+	}
+	if index := remote.files["/var/www/.releases/index"]; index != r2+"\n" {
+		t.Errorf("Expected the index to list %s only got [%s]", r2, index)
+	}
+}
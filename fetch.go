@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A Fetcher brings a site's source directory up to date with where the site
+// is configured to come from. SiteConf.CloneURLType picks the fetcher.
+type Fetcher interface {
+	// Fetch makes src hold the current source of the site, writing the
+	// output of the commands it runs to out, and gives up once ctx is done.
+	// It returns a revision naming what was fetched (a commit, an ETag...),
+	// or "" if there is none.
+	Fetch(ctx context.Context, job SiteConf, src string, out io.Writer) (string, error)
+}
+
+// The available fetchers, by CloneURLType.
+var fetchers = map[string]Fetcher{
+	"git":     gitFetcher{},
+	"hg":      hgFetcher{},
+	"archive": archiveFetcher{},
+	"local":   localFetcher{},
+}
+
+// fetcherFor returns the fetcher for a CloneURLType. Sites registered before
+// the type was used have none, and are git repositories.
+func fetcherFor(cloneType string) (Fetcher, error) {
+	if cloneType == "" {
+		cloneType = "git"
+	}
+	f, ok := fetchers[cloneType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported source type %q", cloneType)
+	}
+	return f, nil
+}
+
+// localFetcher copies a directory of the server, for customers who upload
+// their source by other means. CloneURL is the directory, relative to the
+// local sources directory set by local_root in the [sources] section of the
+// global config file; without it, local sources are disabled.
+//
+// The directory is copied rather than built in place, so that changes made
+// while a build runs don't end up in half of the site.
+type localFetcher struct{}
+
+func (localFetcher) Fetch(ctx context.Context, job SiteConf, src string, out io.Writer) (string, error) {
+	if localroot == "" {
+		return "", fmt.Errorf("local sources are not enabled")
+	}
+	from, err := siteRoot(localroot, job.CloneURL)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Copying from %s...", from)
+	fmt.Fprintf(out, "Copying %s\n", from)
+
+	tmp, err := tempDirFor(src)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := copyTree(ctx, from, tmp, out); err != nil {
+		return "", err
+	}
+	return "", replaceDir(src, tmp)
+}
+
+// Copies the regular files and directories under from into the existing
+// directory to, until ctx is done. Symbolic links and special files are skipped, as they could
+// lead outside of from.
+func copyTree(ctx context.Context, from, to string, out io.Writer) error {
+	return filepath.Walk(from, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return contextError(ctx, err)
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		dest := filepath.Join(to, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.Mkdir(dest, 0755)
+		case fi.Mode().IsRegular():
+			return copyFile(path, dest, fi.Mode().Perm())
+		}
+		fmt.Fprintf(out, "Skipping %s: not a regular file\n", rel)
+		return nil
+	})
+}
+
+func copyFile(from, to string, perm os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Creates a temporary directory next to dir, on the same file system so it
+// can be renamed over it.
+func tempDirFor(dir string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".")
+	if err != nil {
+		return "", err
+	}
+	return tmp, os.Chmod(tmp, 0755)
+}
+
+// Puts the directory tmp in the place of dir, removing the old one.
+func replaceDir(dir, tmp string) error {
+	old := tmp + ".old"
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
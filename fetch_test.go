@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Files put in every source fixture.
+var sourceFixtures = map[string]string{
+	"index.html":                 "home",
+	"_posts/2014-01-01-hello.md": "hello",
+}
+
+// Checks that dir holds exactly the source fixtures.
+func checkSource(t *testing.T, dir string) {
+	n := 0
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			if fi != nil && fi.Name() == ".hg" {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		want, ok := sourceFixtures[filepath.ToSlash(rel)]
+		if b, _ := ioutil.ReadFile(path); !ok || string(b) != want {
+			t.Errorf("Expected %s to hold [%s] got [%s]", rel, want, b)
+		}
+		n++
+		return nil
+	})
+	if n != len(sourceFixtures) {
+		t.Errorf("Expected %d files got %d", len(sourceFixtures), n)
+	}
+}
+
+func TestFetcherFor(t *testing.T) {
+	for cloneType, valid := range map[string]bool{"": true, "git": true, "hg": true, "archive": true, "local": true, "svn": false} {
+		if _, err := fetcherFor(cloneType); (err == nil) != valid {
+			t.Errorf("Expected source type [%s] supported to be %v got %v", cloneType, valid, err)
+		}
+	}
+}
+
+func TestLocalFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir string) { localroot = dir }(localroot)
+	localroot = filepath.Join(dir, "sources")
+	blog := filepath.Join(localroot, "blog")
+	writeSourceFixtures(t, blog)
+	os.Symlink("/etc/passwd", filepath.Join(blog, "passwd"))
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, "stale.html"), []byte("stale"), 0644)
+
+	job := SiteConf{HostName: "a.example.com", CloneURLType: "local", CloneURL: "blog"}
+	if _, err := (localFetcher{}).Fetch(context.Background(), job, src, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	checkSource(t, src)
+
+	job.CloneURL = "../src"
+	if _, err := (localFetcher{}).Fetch(context.Background(), job, src, ioutil.Discard); err == nil {
+		t.Errorf("Expected copying from outside the local sources to fail")
+	}
+}
+
+func TestArchiveFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archives := map[string][]byte{
+		"/blog.tar.gz": tarball(t, "blog-master/", sourceFixtures),
+		"/blog.zip":    zipfile(t, "", sourceFixtures),
+		"/evil.tar.gz": tarball(t, "", map[string]string{"../evil.html": "evil"}),
+	}
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		b, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		w.Write(b)
+	}))
+	defer server.Close()
+
+	for _, name := range []string{"/blog.tar.gz", "/blog.zip"} {
+		src := filepath.Join(dir, name[1:])
+		job := SiteConf{HostName: "a.example.com", CloneURLType: "archive", CloneURL: server.URL + name}
+
+		downloads = 0
+		for i := 0; i < 2; i++ {
+			rev, err := (archiveFetcher{}).Fetch(context.Background(), job, src, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != name {
+				t.Errorf("Expected revision [%s] got [%s]", name, rev)
+			}
+			checkSource(t, src)
+		}
+		if downloads != 1 {
+			t.Errorf("Expected %s to be downloaded once got %d", name, downloads)
+		}
+	}
+
+	for _, name := range []string{"/evil.tar.gz", "/missing.zip"} {
+		job := SiteConf{HostName: "a.example.com", CloneURLType: "archive", CloneURL: server.URL + name}
+		if _, err := (archiveFetcher{}).Fetch(context.Background(), job, filepath.Join(dir, "bad"), ioutil.Discard); err == nil {
+			t.Errorf("Expected fetching %s to fail", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.html")); !os.IsNotExist(err) {
+		t.Errorf("Expected evil.html not to be written")
+	}
+}
+
+func TestHgFetcher(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "jkl-hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	writeSourceFixtures(t, upstream)
+	for _, args := range [][]string{{"init"}, {"commit", "-A", "-u", "test", "-m", "one"}} {
+		if _, err := hgOutput(upstream, args...); err != nil {
+			t.Fatalf("hg %v: %v", args, err)
+		}
+	}
+
+	src := filepath.Join(dir, "src")
+	job := SiteConf{HostName: "a.example.com", CloneURLType: "hg", CloneURL: upstream}
+	for i := 0; i < 2; i++ {
+		node, err := (hgFetcher{}).Fetch(context.Background(), job, src, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(node) != 40 {
+			t.Errorf("Expected a changeset ID got [%s]", node)
+		}
+		ioutil.WriteFile(filepath.Join(src, "stray.html"), []byte("stray"), 0644)
+	}
+	os.Remove(filepath.Join(src, "stray.html"))
+	checkSource(t, src)
+}
+
+func writeSourceFixtures(t *testing.T, dir string) {
+	for name, content := range sourceFixtures {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tarball(t *testing.T, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: prefix + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipfile(t *testing.T, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(prefix + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitFetcher makes src an exact copy of the site's branch (or the remote's
+// default branch), and returns the SHA of the checked out commit.
+//
+// Instead of pulling, it fetches and hard resets to the remote ref, so
+// force-pushes and local modifications can't get in the way. A checkout that
+// is missing or broken is cloned again from scratch, as is one that needs
+// deployment.
+//
+// Submodules and Git LFS files are fetched too for the sites that ask for
+// them.
+type gitFetcher struct{}
+
+// Protocols submodules may be fetched with. Local paths and file:// URLs are
+// left out, lest a repository pull in another tenant's checkout. Plain http
+// is left out too for the sites having an access token.
+var submoduleProtocols = "https:http:ssh:git"
+
+// Environment of every git command: LFS files are only downloaded when the
+// site asks for them, by gitLFS.
+var gitEnv = []string{"GIT_LFS_SKIP_SMUDGE=1"}
+
+func (gitFetcher) Fetch(ctx context.Context, job SiteConf, src string, out io.Writer) (string, error) {
+	env, cleanup, err := gitCredentials(job)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	if job.NeedsDeployment || !isGitCheckout(src) {
+		if err := gitClone(ctx, job, src, env, out); err != nil {
+			return "", err
+		}
+	} else if err := gitUpdate(ctx, job, src, env, out); err != nil {
+		return "", err
+	}
+
+	if job.Submodules {
+		if err := gitSubmodules(ctx, job, src, env, out); err != nil {
+			return "", err
+		}
+	}
+	if job.LFS {
+		if err := git(ctx, src, env, out, "lfs", "pull"); err != nil {
+			return "", err
+		}
+	}
+
+	sha, err := gitOutput(src, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("reading the checked out commit: %v", err)
+	}
+	return sha, nil
+}
+
+// Clones the repository into src, replacing whatever was there. env holds
+// the credentials to use.
+func gitClone(ctx context.Context, job SiteConf, src string, env []string, out io.Writer) error {
+	log.Printf("Cloning from source...")
+
+	if err := os.RemoveAll(src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		return err
+	}
+
+	args := []string{"clone"}
+	if job.Branch != "" {
+		args = append(args, "--branch", job.Branch)
+	}
+	args = append(args, "--", job.CloneURL, src)
+
+	if err := git(ctx, "", env, out, args...); err != nil {
+		os.RemoveAll(src) // don't leave half a clone behind
+		return err
+	}
+	return nil
+}
+
+// Fetches the branch and resets the checkout in src to it, dropping any
+// local change. env holds the credentials to fetch with.
+func gitUpdate(ctx context.Context, job SiteConf, src string, env []string, out io.Writer) error {
+	log.Printf("Fetching from source...")
+
+	// The clone URL may have changed since the checkout was made
+	if url, _ := gitOutput(src, "config", "--get", "remote.origin.url"); url != job.CloneURL {
+		if err := git(ctx, src, gitEnv, out, "remote", "set-url", "origin", job.CloneURL); err != nil {
+			return err
+		}
+	}
+
+	target := "refs/remotes/origin/HEAD"
+	if job.Branch != "" {
+		target = "refs/remotes/origin/" + job.Branch
+		refspec := "+refs/heads/" + job.Branch + ":" + target
+		if err := git(ctx, src, env, out, "fetch", "--prune", "origin", refspec); err != nil {
+			return err
+		}
+	} else {
+		if err := git(ctx, src, env, out, "fetch", "--prune", "origin"); err != nil {
+			return err
+		}
+		// Follow the remote if its default branch changed
+		if err := git(ctx, src, env, out, "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+	}
+
+	if err := git(ctx, src, gitEnv, out, "reset", "--hard", target); err != nil {
+		return err
+	}
+	return git(ctx, src, gitEnv, out, "clean", "-ffdx")
+}
+
+// Checks out the submodules of the checkout in src, recursively, at the
+// commits it records, dropping any local change in them.
+func gitSubmodules(ctx context.Context, job SiteConf, src string, env []string, out io.Writer) error {
+	log.Printf("Updating submodules...")
+
+	protocols := submoduleProtocols
+	if job.AccessToken != "" {
+		allowed := []string{}
+		for _, p := range strings.Split(protocols, ":") {
+			if p != "http" {
+				allowed = append(allowed, p)
+			}
+		}
+		protocols = strings.Join(allowed, ":")
+	}
+	env = append(env, "GIT_ALLOW_PROTOCOL="+protocols)
+	if err := git(ctx, src, env, out, "submodule", "sync", "--recursive"); err != nil {
+		return err
+	}
+	if err := git(ctx, src, env, out, "submodule", "update", "--init", "--recursive", "--force"); err != nil {
+		return err
+	}
+	return git(ctx, src, gitEnv, out, "submodule", "foreach", "--recursive", "git", "clean", "-ffdx")
+}
+
+// gitCredentials returns the environment handing git the site's deploy key
+// and access token, if it has any, along with a function to call once git
+// is done to remove the key file. Only commands talking to the remote should
+// get it. The token only goes to the host of the clone URL, whatever other
+// hosts the submodules of the repository are on.
+func gitCredentials(job SiteConf) (env []string, cleanup func(), err error) {
+	// Fail rather than wait for a password nobody will type
+	env = append([]string{"GIT_TERMINAL_PROMPT=0"}, gitEnv...)
+	cleanup = func() {}
+
+	if job.DeployKey != "" {
+		key, remove, err := writeDeployKey(job)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		cleanup = remove
+		env = append(env, "GIT_SSH_COMMAND=ssh -i '"+key+"' "+sshOptions)
+	}
+
+	// Never send the token in the clear
+	if u, _ := url.Parse(job.CloneURL); job.AccessToken != "" && u != nil && u.Scheme == "https" && u.Host != "" {
+		token, err := decryptSecret(job.HostName, job.AccessToken)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("access token: %v", err)
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.https://"+u.Host+"/.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+
+	return env, cleanup, nil
+}
+
+// Returns True if dir holds a usable git checkout.
+func isGitCheckout(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return false
+	}
+	if top, err := gitOutput(dir, "rev-parse", "--show-toplevel"); err != nil || !sameDir(top, dir) {
+		return false
+	}
+	_, err := gitOutput(dir, "rev-parse", "--verify", "HEAD")
+	return err == nil
+}
+
+// Runs a git command in dir, with env added to its environment and its
+// output going to out.
+func git(ctx context.Context, dir string, env []string, out io.Writer, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := runCommand(ctx, cmd, out); err != nil {
+		return fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// Runs a quick, local git command in dir and returns its trimmed output.
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	return strings.TrimSpace(string(b)), err
+}
+
+// Returns True if both paths lead to the same directory.
+func sameDir(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Runs git in dir for a test, failing it on error.
+func testGit(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	out, err := gitOutput(dir, args...)
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return out
+}
+
+func TestGitFetcher(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "jkl-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	src := filepath.Join(dir, "src")
+	os.Mkdir(upstream, 0755)
+	testGit(t, upstream, "init", "-q")
+	ioutil.WriteFile(filepath.Join(upstream, "index.html"), []byte("one"), 0644)
+	testGit(t, upstream, "add", "index.html")
+	testGit(t, upstream, "commit", "-q", "-m", "one")
+
+	fetcher := gitFetcher{}
+	job := SiteConf{HostName: "test.example.com", CloneURL: upstream, NeedsDeployment: true}
+
+	// First sync clones
+	sha, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := testGit(t, upstream, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("Expected commit [%s] got [%s]", head, sha)
+	}
+	job.NeedsDeployment = false
+
+	// Local changes and force-pushes don't stop the checkout from
+	// following the remote
+	ioutil.WriteFile(filepath.Join(src, "index.html"), []byte("local"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "stray.html"), []byte("stray"), 0644)
+	ioutil.WriteFile(filepath.Join(upstream, "index.html"), []byte("two"), 0644)
+	testGit(t, upstream, "commit", "-q", "-a", "--amend", "-m", "two")
+
+	sha, err = fetcher.Fetch(context.Background(), job, src, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := testGit(t, upstream, "rev-parse", "HEAD"); sha != head {
+		t.Errorf("Expected commit [%s] got [%s]", head, sha)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(src, "index.html")); string(b) != "two" {
+		t.Errorf("Expected index.html to be [two] got [%s]", b)
+	}
+	if _, err := os.Stat(filepath.Join(src, "stray.html")); !os.IsNotExist(err) {
+		t.Errorf("Expected stray.html to be cleaned up")
+	}
+
+	// A broken checkout is cloned again
+	os.RemoveAll(filepath.Join(src, ".git", "objects"))
+	if _, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if !isGitCheckout(src) {
+		t.Errorf("Expected %s to be cloned again", src)
+	}
+
+	// A missing branch fails the sync
+	job.Branch = "missing"
+	if _, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard); err == nil {
+		t.Errorf("Expected syncing a missing branch to fail")
+	}
+}
+
+func TestGitFetcherSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "jkl-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fixtures live on the local file system
+	defer func(protocols string) { submoduleProtocols = protocols }(submoduleProtocols)
+	submoduleProtocols = "file"
+
+	theme := filepath.Join(dir, "theme")
+	upstream := filepath.Join(dir, "upstream")
+	src := filepath.Join(dir, "src")
+	for _, repo := range []string{theme, upstream} {
+		os.Mkdir(repo, 0755)
+		testGit(t, repo, "init", "-q")
+		ioutil.WriteFile(filepath.Join(repo, "index.html"), []byte(filepath.Base(repo)), 0644)
+		testGit(t, repo, "add", "index.html")
+		testGit(t, repo, "commit", "-q", "-m", "one")
+	}
+	testGit(t, upstream, "-c", "protocol.file.allow=always", "submodule", "add", "-q", theme, "_theme")
+	testGit(t, upstream, "commit", "-q", "-m", "theme")
+
+	fetcher := gitFetcher{}
+	job := SiteConf{HostName: "test.example.com", CloneURL: upstream, NeedsDeployment: true}
+	if _, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "_theme", "index.html")); !os.IsNotExist(err) {
+		t.Errorf("Expected submodules not to be fetched unless asked for")
+	}
+
+	job.NeedsDeployment = false
+	job.Submodules = true
+	if _, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(src, "_theme", "index.html")); string(b) != "theme" {
+		t.Errorf("Expected the theme submodule to be checked out got [%s]", b)
+	}
+
+	// Submodules from the local file system aren't fetched for real
+	submoduleProtocols = "https:http:ssh:git"
+	os.RemoveAll(src)
+	if _, err := fetcher.Fetch(context.Background(), job, src, ioutil.Discard); err == nil {
+		t.Errorf("Expected a submodule with a local path to be refused")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// gitDeployer commits sites to a branch of a git repository, gh-pages by
+// default, and pushes it, for hosts serving a branch like GitHub Pages. The
+// branch is kept checked out in the deploy directory, and is created when
+// the repository doesn't have it yet.
+//
+// The site's deploy key and access token are used to push, the token only
+// when the repository is on the same host as the site's source.
+type gitDeployer struct {
+	job    SiteConf
+	url    string
+	branch string
+	dir    string
+	out    io.Writer
+	ready  bool // Whether dir was brought up to date with the branch
+}
+
+func newGitDeployer(job SiteConf, conf *DeployConfig, out io.Writer) (*gitDeployer, error) {
+	if !isCloneURL(conf.URL, cloneURLSchemes["git"]) {
+		return nil, fmt.Errorf("invalid git repository URL %q", conf.URL)
+	}
+	branch := conf.Branch
+	if branch == "" {
+		branch = "gh-pages"
+	}
+	if !isRefName(branch) {
+		return nil, fmt.Errorf("invalid branch %q", branch)
+	}
+	dir, _ := filepath.Abs(filepath.Join(basedir, deploydir, job.HostName))
+	return &gitDeployer{job: job, url: conf.URL, branch: branch, dir: dir, out: out}, nil
+}
+
+func (d *gitDeployer) Put(ctx context.Context, key, file string) error {
+	if err := d.open(ctx); err != nil {
+		return err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(d.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return replaceFile(file, dest, fi.Mode().Perm())
+}
+
+func (d *gitDeployer) Delete(ctx context.Context, key string) error {
+	if err := d.open(ctx); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(d.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the files of the branch, but for the repository itself and
+// the .nojekyll file added by Finalize.
+func (d *gitDeployer) List(ctx context.Context) (map[string]string, error) {
+	if err := d.open(ctx); err != nil {
+		return nil, err
+	}
+	return listDir(ctx, d.dir, func(key string) bool {
+		return key == ".git" || key == ".nojekyll"
+	})
+}
+
+// Finalize commits the changes, if any, and pushes them. A .nojekyll file
+// keeps GitHub Pages from running Jekyll on the site again.
+func (d *gitDeployer) Finalize(ctx context.Context) error {
+	if err := d.open(ctx); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.dir, ".nojekyll"), nil, 0644); err != nil {
+		return err
+	}
+	if err := git(ctx, d.dir, gitEnv, d.out, "add", "--all"); err != nil {
+		return err
+	}
+	if status, err := gitOutput(d.dir, "status", "--porcelain"); err != nil || status == "" {
+		return err
+	}
+
+	email := "jkl-baas@" + d.job.HostName
+	err := git(ctx, d.dir, append(gitEnv,
+		"GIT_AUTHOR_NAME=jkl-baas", "GIT_AUTHOR_EMAIL="+email,
+		"GIT_COMMITTER_NAME=jkl-baas", "GIT_COMMITTER_EMAIL="+email,
+	), d.out, "commit", "--quiet", "-m", "Deploy "+d.job.HostName)
+	if err != nil {
+		return err
+	}
+
+	env, cleanup, err := d.credentials()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return git(ctx, d.dir, env, d.out, "push", "origin", "HEAD:refs/heads/"+d.branch)
+}
+
+// Makes the deploy directory a clean checkout of the branch, or of an empty
+// new branch when the repository doesn't have it, once per deploy.
+func (d *gitDeployer) open(ctx context.Context) error {
+	if d.ready {
+		return nil
+	}
+
+	if !isGitRepository(d.dir) {
+		if err := os.RemoveAll(d.dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(d.dir, 0755); err != nil {
+			return err
+		}
+		if err := git(ctx, d.dir, gitEnv, d.out, "init", "--quiet"); err != nil {
+			return err
+		}
+		if err := git(ctx, d.dir, gitEnv, d.out, "remote", "add", "origin", d.url); err != nil {
+			return err
+		}
+	} else if url, _ := gitOutput(d.dir, "config", "--get", "remote.origin.url"); url != d.url {
+		if err := git(ctx, d.dir, gitEnv, d.out, "remote", "set-url", "origin", d.url); err != nil {
+			return err
+		}
+	}
+
+	env, cleanup, err := d.credentials()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	remote := "refs/remotes/origin/" + d.branch
+	if err := git(ctx, d.dir, env, d.out, "ls-remote", "--exit-code", "--heads", "origin", d.branch); err == nil {
+		if err := git(ctx, d.dir, env, d.out, "fetch", "origin", "+refs/heads/"+d.branch+":"+remote); err != nil {
+			return err
+		}
+		if err := git(ctx, d.dir, gitEnv, d.out, "checkout", "--quiet", "--force", "-B", d.branch, remote); err != nil {
+			return err
+		}
+	} else if ctx.Err() != nil {
+		return err
+	} else {
+		// A new branch, without history
+		if err := git(ctx, d.dir, gitEnv, d.out, "symbolic-ref", "HEAD", "refs/heads/"+d.branch); err != nil {
+			return err
+		}
+		gitOutput(d.dir, "update-ref", "-d", "refs/heads/"+d.branch)
+		if err := git(ctx, d.dir, gitEnv, d.out, "read-tree", "--empty"); err != nil {
+			return err
+		}
+	}
+	if err := git(ctx, d.dir, gitEnv, d.out, "clean", "-ffdxq"); err != nil {
+		return err
+	}
+
+	d.ready = true
+	return nil
+}
+
+// Returns the credentials to push with.
+func (d *gitDeployer) credentials() ([]string, func(), error) {
+	creds := d.job
+	creds.CloneURL = d.url
+	if a, b := urlHost(d.url), urlHost(d.job.CloneURL); a == "" || a != b {
+		creds.AccessToken = ""
+	}
+	return gitCredentials(creds)
+}
+
+// Returns True if dir holds a git repository of its own, which may not have
+// any commit yet.
+func isGitRepository(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return false
+	}
+	top, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	return err == nil && sameDir(top, dir)
+}
+
+// Returns the host of a URL, or "" if it has none.
+func urlHost(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A HeaderRule sets HTTP headers on the deployed files matching Glob. Globs
+// without a slash match the file name in any directory, others the whole
+// path, e.g. "*.pdf" or "assets/*.css".
+type HeaderRule struct {
+	Glob    string
+	Headers map[string]string
+}
+
+// The headers rules may set, which S3 keeps with the objects and sends
+// back. Headers starting with x-amz-meta- are allowed too.
+var ruleHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Language",
+	"Content-Type",
+	"Expires",
+}
+
+// Cache-Control of fingerprinted files, when enabled.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// Names of files with a content hash, such as app-3f2a9c1b.css or
+// main.3f2a9c1b.js.
+var fingerprinted = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^./]+$`)
+
+// checkRules returns an error if a rule of conf is invalid.
+func checkRules(conf *DeployConfig) error {
+	for _, rule := range conf.Headers {
+		if _, err := path.Match(rule.Glob, ""); err != nil || rule.Glob == "" {
+			return fmt.Errorf("invalid glob %q", rule.Glob)
+		}
+		for name, value := range rule.Headers {
+			if !isRuleHeader(name) {
+				return fmt.Errorf("header %s can't be set", name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid value for header %s", name)
+			}
+		}
+	}
+	for ext, age := range conf.MaxAge {
+		if age < 0 {
+			return fmt.Errorf("invalid max-age for %s files", ext)
+		}
+	}
+	return nil
+}
+
+// Returns True if rules may set the header.
+func isRuleHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if strings.HasPrefix(name, "X-Amz-Meta-") {
+		return true
+	}
+	for _, h := range ruleHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fileHeaders returns the HTTP headers the file deployed as key gets from
+// conf, and whether it should be gzipped. Later rules win over earlier ones,
+// which win over MaxAge and Immutable.
+//
+// There is no brotli: S3 sends every client the one object a key has, with
+// its Content-Encoding, and can't pick a variant by Accept-Encoding. Gzip
+// is the encoding all browsers take.
+func fileHeaders(conf *DeployConfig, key string) (h http.Header, compress bool) {
+	h = http.Header{}
+	ext := strings.TrimPrefix(path.Ext(key), ".")
+	if typ := mime.TypeByExtension(path.Ext(key)); typ != "" {
+		h.Set("Content-Type", typ)
+	}
+
+	if conf.Immutable && fingerprinted.MatchString(path.Base(key)) {
+		h.Set("Cache-Control", immutableCacheControl)
+	} else if age, ok := conf.MaxAge[ext]; ok {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", age))
+	}
+
+	for _, rule := range conf.Headers {
+		name := key
+		if !strings.Contains(rule.Glob, "/") {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(rule.Glob, name); !ok {
+			continue
+		}
+		for k, v := range rule.Headers {
+			h.Set(k, v)
+		}
+	}
+
+	for _, e := range conf.Gzip {
+		if strings.TrimPrefix(e, ".") == ext {
+			h.Set("Content-Encoding", "gzip")
+			return h, true
+		}
+	}
+	return h, false
+}
+
+// Compresses the file f with gzip into a temporary file, always the same
+// way so that its hash stays the same from one deploy to the next. The
+// returned file is at its start, and must be removed once closed.
+func gzipFile(f io.Reader) (*os.File, error) {
+	tmp, err := ioutil.TempFile("", "jkl-gzip")
+	if err != nil {
+		return nil, err
+	}
+	w, err := gzip.NewWriterLevel(tmp, gzip.BestCompression)
+	if err == nil {
+		_, err = io.Copy(w, f)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
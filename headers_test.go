@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFileHeaders(t *testing.T) {
+	conf := &DeployConfig{
+		Immutable: true,
+		MaxAge:    map[string]int{"html": 300, "css": 3600},
+		Gzip:      []string{".html", "css"},
+		Headers: []HeaderRule{
+			{Glob: "*.pdf", Headers: map[string]string{"Content-Disposition": "attachment"}},
+			{Glob: "blog/*.html", Headers: map[string]string{"cache-control": "no-cache"}},
+		},
+	}
+	tests := map[string][3]string{ // Cache-Control, Content-Encoding, Content-Disposition
+		"index.html":           {"public, max-age=300", "gzip", ""},
+		"blog/post.html":       {"no-cache", "gzip", ""},
+		"css/app-3f2a9c1b.css": {immutableCacheControl, "gzip", ""},
+		"css/app.css":          {"public, max-age=3600", "gzip", ""},
+		"docs/paper.pdf":       {"", "", "attachment"},
+	}
+	for key, want := range tests {
+		h, compress := fileHeaders(conf, key)
+		got := [3]string{h.Get("Cache-Control"), h.Get("Content-Encoding"), h.Get("Content-Disposition")}
+		if got != want || compress != (want[1] == "gzip") {
+			t.Errorf("Expected %s to get %q got %q", key, want, got)
+		}
+	}
+
+	if h, _ := fileHeaders(conf, "index.html"); h.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Expected an HTML content type got [%s]", h.Get("Content-Type"))
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	valid := &DeployConfig{Headers: []HeaderRule{
+		{Glob: "*.pdf", Headers: map[string]string{"Content-Disposition": "attachment", "x-amz-meta-author": "me"}},
+	}}
+	if err := checkRules(valid); err != nil {
+		t.Errorf("Expected rules to be valid got %v", err)
+	}
+
+	invalid := []*DeployConfig{
+		{Headers: []HeaderRule{{Glob: "[", Headers: map[string]string{}}}},
+		{Headers: []HeaderRule{{Glob: "*", Headers: map[string]string{"Content-Encoding": "gzip"}}}},
+		{Headers: []HeaderRule{{Glob: "*", Headers: map[string]string{"Expires": "0\r\nX-Evil: 1"}}}},
+		{MaxAge: map[string]int{"html": -1}},
+	}
+	for _, conf := range invalid {
+		if err := checkRules(conf); err == nil {
+			t.Errorf("Expected %+v to be rejected", conf)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hgFetcher keeps src a clean working copy of a Mercurial repository, at the
+// tip of the site's branch ("default" when unset), and returns the node ID
+// of the checked out changeset. Like git, a working copy that is missing,
+// broken or needs deployment is cloned again.
+type hgFetcher struct{}
+
+func (hgFetcher) Fetch(ctx context.Context, job SiteConf, src string, out io.Writer) (string, error) {
+	branch := job.Branch
+	if branch == "" {
+		branch = "default"
+	}
+
+	if job.NeedsDeployment || !isHgCheckout(src) {
+		log.Printf("Cloning from source...")
+		if err := os.RemoveAll(src); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			return "", err
+		}
+		cmd := exec.Command("hg", "clone", "--updaterev", branch, "--", job.CloneURL, src)
+		if err := runCommand(ctx, cmd, out); err != nil {
+			os.RemoveAll(src)
+			return "", fmt.Errorf("hg clone: %v", err)
+		}
+	} else {
+		log.Printf("Fetching from source...")
+		if err := hg(ctx, src, out, "pull", "--", job.CloneURL); err != nil {
+			return "", err
+		}
+		if err := hg(ctx, src, out, "update", "--clean", "--rev", branch); err != nil {
+			return "", err
+		}
+		if err := hg(ctx, src, out, "--config", "extensions.purge=", "purge", "--all"); err != nil {
+			return "", err
+		}
+	}
+
+	node, err := hgOutput(src, "log", "--rev", ".", "--template", "{node}")
+	if err != nil {
+		return "", fmt.Errorf("reading the checked out changeset: %v", err)
+	}
+	return node, nil
+}
+
+// Returns True if dir holds a usable Mercurial working copy.
+func isHgCheckout(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".hg")); err != nil {
+		return false
+	}
+	_, err := hgOutput(dir, "root")
+	return err == nil
+}
+
+// Runs an hg command in dir, with its output going to out.
+func hg(ctx context.Context, dir string, out io.Writer, args ...string) error {
+	cmd := exec.Command("hg", args...)
+	cmd.Dir = dir
+	if err := runCommand(ctx, cmd, out); err != nil {
+		return fmt.Errorf("hg %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// Runs a quick, local hg command in dir and returns its trimmed output.
+func hgOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("hg", args...)
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	return strings.TrimSpace(string(b)), err
+}
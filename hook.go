@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrUnknownHookSender = errors.New("Unrecognized webhook sender")
+)
+
+// Largest webhook payload we are willing to read.
+const maxHookPayload = 5 << 20
+
+// A pushEvent is the part of a GitHub, GitLab or Gitea push payload we care
+// about.
+type pushEvent struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"` // GitLab
+	UserName    string `json:"user_name"`    // GitLab
+
+	Pusher struct {
+		Name     string `json:"name"`     // GitHub
+		Login    string `json:"login"`    // Gitea
+		Username string `json:"username"` // Gitea
+	} `json:"pusher"`
+
+	Repository struct {
+		DefaultBranch string `json:"default_branch"` // GitHub, Gitea
+	} `json:"repository"`
+
+	Project struct {
+		DefaultBranch string `json:"default_branch"` // GitLab
+	} `json:"project"`
+}
+
+// Returns the SHA of the commit the branch now points to.
+func (e *pushEvent) commit() string {
+	if e.CheckoutSHA != "" {
+		return e.CheckoutSHA
+	}
+	return e.After
+}
+
+// Returns the name of whoever pushed.
+func (e *pushEvent) pusher() string {
+	for _, name := range []string{e.UserName, e.Pusher.Name, e.Pusher.Login, e.Pusher.Username} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the default branch of the pushed repository, if the payload says.
+func (e *pushEvent) defaultBranch() string {
+	if e.Repository.DefaultBranch != "" {
+		return e.Repository.DefaultBranch
+	}
+	return e.Project.DefaultBranch
+}
+
+// Returns True if the push should build a site following branch, or the
+// repository's default branch when branch is empty. Only pushes to branches
+// count, not to tags or pull request refs, and only to that branch when it
+// is known.
+func (e *pushEvent) builds(branch string) bool {
+	if !strings.HasPrefix(e.Ref, "refs/heads/") || e.isDelete() {
+		return false
+	}
+	if branch == "" {
+		branch = e.defaultBranch()
+	}
+	return branch == "" || e.Ref == "refs/heads/"+branch
+}
+
+// Returns True if the push removed the branch rather than updating it.
+func (e *pushEvent) isDelete() bool {
+	return strings.Trim(e.commit(), "0") == ""
+}
+
+// hookSender identifies which forge sent the request, and whether the event
+// is a push. Gitea also sends GitHub's headers, so it is checked first.
+func hookSender(r *http.Request) (sender string, push bool) {
+	switch {
+	case r.Header.Get("X-Gitea-Event") != "":
+		return "gitea", r.Header.Get("X-Gitea-Event") == "push"
+	case r.Header.Get("X-Gitlab-Event") != "":
+		return "gitlab", r.Header.Get("X-Gitlab-Event") == "Push Hook"
+	case r.Header.Get("X-GitHub-Event") != "":
+		return "github", r.Header.Get("X-GitHub-Event") == "push"
+	}
+	return "", false
+}
+
+// verifyHook checks the request was sent by someone knowing the site's
+// APISecret, using the mechanism native to each forge:
+//
+//   - GitHub signs the body with HMAC-SHA256 in X-Hub-Signature-256
+//   - Gitea does the same in X-Gitea-Signature, without the "sha256=" prefix
+//   - GitLab sends the secret itself in X-Gitlab-Token
+func verifyHook(r *http.Request, sender string, body []byte, secret string) error {
+	var sig string
+	switch sender {
+	case "github":
+		sig = strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	case "gitea":
+		sig = r.Header.Get("X-Gitea-Signature")
+	case "gitlab":
+		token := r.Header.Get("X-Gitlab-Token")
+		if token == "" {
+			return ErrAuthMissing
+		}
+		if !secretsEqual(token, secret) {
+			return ErrAuthInvalid
+		}
+		return nil
+	default:
+		return ErrUnknownHookSender
+	}
+
+	if sig == "" {
+		return ErrAuthMissing
+	}
+	if !secretsEqual(sig, signPayload(secret, body)) {
+		return ErrAuthInvalid
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of a webhook body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hookHandler serves /hook/{hostname}: it accepts push events from GitHub,
+// GitLab and Gitea, and queues a build when the site's branch was pushed.
+func hookHandler(store SiteStore, queue *BuildQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			sendResponse(w, APIResponse{
+				Code:    405,
+				Message: "Webhooks must be POSTed",
+			})
+			return
+		}
+
+		// Unknown hosts fail the signature check, like wrong secrets do
+		hostname := strings.Trim(strings.TrimPrefix(r.URL.Path, "/hook/"), "/")
+		site, ok := store.Get(hostname)
+		secret := site.APISecret
+		if !ok {
+			secret = unknownHostSecret
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookPayload))
+		if err != nil {
+			sendResponse(w, APIResponse{
+				Code:    413,
+				Message: "Payload too large",
+			})
+			return
+		}
+
+		sender, push := hookSender(r)
+		if sender == "" {
+			sendResponse(w, APIResponse{
+				Code:    400,
+				Message: ErrUnknownHookSender.Error(),
+			})
+			return
+		}
+
+		if err := verifyHook(r, sender, body, secret); err != nil {
+			authFailed(w, err)
+			return
+		}
+
+		// Answer pings and other events, so the forge shows the hook as
+		// working, but don't build for them.
+		if !push {
+			sendResponse(w, APIResponse{
+				Code:    200,
+				Message: "Event ignored",
+			})
+			return
+		}
+
+		event := pushEvent{}
+		if err := json.Unmarshal(body, &event); err != nil {
+			sendResponse(w, APIResponse{
+				Code:    400,
+				Message: fmt.Sprintf("Malformed push payload: %v", err),
+			})
+			return
+		}
+
+		if !event.builds(site.Branch) {
+			sendResponse(w, APIResponse{
+				Code:    200,
+				Message: fmt.Sprintf("Push to %s ignored", event.Ref),
+			})
+			return
+		}
+
+		build := NewBuild(site, sender)
+		build.Ref = event.Ref
+		build.Commit = event.commit()
+		build.Pusher = event.pusher()
+
+		queued, coalesced := queue.Enqueue(build)
+
+		msg := "Build queued"
+		if coalesced {
+			msg = "Build already queued"
+		}
+		sendResponse(w, APIResponse{
+			Code:    202,
+			Message: msg,
+			Data:    queued,
+		})
+	}
+}
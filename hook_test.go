@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestVerifyHook(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	secret := "s3cr3t"
+
+	tests := map[string]struct {
+		header string
+		value  string
+		err    error
+	}{
+		"github": {"X-Hub-Signature-256", "sha256=" + signPayload(secret, body), nil},
+		"gitea":  {"X-Gitea-Signature", signPayload(secret, body), nil},
+		"gitlab": {"X-Gitlab-Token", secret, nil},
+	}
+
+	for sender, test := range tests {
+		r, _ := http.NewRequest("POST", "/hook/blog.example.com", nil)
+		if err := verifyHook(r, sender, body, secret); err != ErrAuthMissing {
+			t.Errorf("Expected error [%v] got [%v] for unsigned %s hook", ErrAuthMissing, err, sender)
+		}
+
+		r.Header.Set(test.header, test.value)
+		if err := verifyHook(r, sender, body, secret); err != test.err {
+			t.Errorf("Expected error [%v] got [%v] for %s hook", test.err, err, sender)
+		}
+		if err := verifyHook(r, sender, body, "guess"); err != ErrAuthInvalid {
+			t.Errorf("Expected error [%v] got [%v] for %s hook with the wrong secret", ErrAuthInvalid, err, sender)
+		}
+	}
+}
+
+func TestHookSender(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		sender  string
+		push    bool
+	}{
+		{map[string]string{"X-GitHub-Event": "push"}, "github", true},
+		{map[string]string{"X-GitHub-Event": "ping"}, "github", false},
+		{map[string]string{"X-Gitlab-Event": "Push Hook"}, "gitlab", true},
+		{map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push"}, "gitea", true},
+		{map[string]string{}, "", false},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "/hook/blog.example.com", nil)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if sender, push := hookSender(r); sender != test.sender || push != test.push {
+			t.Errorf("Expected [%s %v] got [%s %v] for headers %v", test.sender, test.push, sender, push, test.headers)
+		}
+	}
+}
+
+func TestPushBuilds(t *testing.T) {
+	sha := "3f2a9c1b3f2a9c1b3f2a9c1b3f2a9c1b3f2a9c1b"
+	tests := []struct {
+		ref, after, branch, defaultBranch string
+		builds                            bool
+	}{
+		{"refs/heads/main", sha, "main", "", true},
+		{"refs/heads/dev", sha, "main", "", false},
+		{"refs/heads/main", sha, "", "main", true},
+		{"refs/heads/dev", sha, "", "main", false},
+		{"refs/heads/dev", sha, "", "", true},
+		{"refs/tags/v1.0", sha, "", "", false},
+		{"refs/pull/1/head", sha, "", "", false},
+		{"refs/heads/main", "0000000000000000000000000000000000000000", "main", "", false},
+	}
+	for _, test := range tests {
+		e := pushEvent{Ref: test.ref, After: test.after}
+		e.Repository.DefaultBranch = test.defaultBranch
+		if got := e.builds(test.branch); got != test.builds {
+			t.Errorf("Expected %v for a push to %s (branch [%s], default [%s]) got %v", test.builds, test.ref, test.branch, test.defaultBranch, got)
+		}
+	}
+}
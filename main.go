@@ -2,25 +2,24 @@ package main
 
 import (
 	"bitbucket.org/kardianos/osext"
+	"bytes"
 	"code.google.com/p/monnand-goconf"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/howeyc/fsnotify"
-	"github.com/nu7hatch/gouuid"
 	"io"
-	"io/ioutil"
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/s3"
 	"log"
-	"mime"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	//"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -33,27 +32,110 @@ type SiteConf struct {
 	CloneURL,
 	APISecret string
 	NeedsDeployment bool
+
+	// Branch that is checked out and whose pushes trigger a build. Empty
+	// means the repository's default branch.
+	Branch string
+
+	// Directory of the repository holding the site, e.g. "docs". Empty
+	// means the repository root.
+	SourceDir string
+
+	// SSH deploy key used to clone and fetch git repositories over ssh. The
+	// private half is kept encrypted, the public half is shown to the site
+	// owner to add to their repository.
+	DeployKey       string
+	DeployKeyPublic string
+
+	// Token sent to clone and fetch git repositories over https, kept
+	// encrypted.
+	AccessToken string
+
+	// Whether git submodules, recursively, and Git LFS files are fetched
+	// along with the repository.
+	Submodules bool
+	LFS        bool
+
+	// How long each phase of the site's builds may take.
+	Timeouts PhaseTimeouts
+}
+
+// siteDirs returns the absolute paths of the directories holding a site's
+// source checkout, generated files and synced output.
+func siteDirs(hostname string) (src, gen, out string) {
+	src, _ = filepath.Abs(filepath.Join(basedir, sitedir, hostname))
+	gen, _ = filepath.Abs(filepath.Join(basedir, gendir, hostname))
+	out, _ = filepath.Abs(filepath.Join(basedir, outdir, hostname))
+	return
+}
+
+// siteRoot returns the directory of the checkout src holding the site. It
+// makes sure symbolic links don't lead it out of the checkout.
+func siteRoot(src, sourceDir string) (string, error) {
+	root, err := filepath.EvalSymlinks(filepath.Join(src, sourceDir))
+	if err != nil {
+		return "", fmt.Errorf("source directory %q: %v", sourceDir, err)
+	}
+	checkout, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return "", err
+	}
+	if root != checkout && !strings.HasPrefix(root, checkout+string(filepath.Separator)) {
+		return "", fmt.Errorf("source directory %q is outside of the repository", sourceDir)
+	}
+	return root, nil
+}
+
+// Strips the secrets from a site configuration, so it can be shown.
+func (s SiteConf) Redacted() SiteConf {
+	s.APISecret = ""
+	s.DeployKey = ""
+	s.AccessToken = ""
+	return s
+}
+
+// findSite returns the site configured for hostname, or nil.
+func findSite(sites []SiteConf, hostname string) *SiteConf {
+	for i := range sites {
+		if sites[i].HostName == hostname {
+			return &sites[i]
+		}
+	}
+	return nil
 }
 
 type APIResponse struct {
 	Code    uint
 	Message string
+	Data    interface{}  `json:",omitempty"`
+	Errors  []FieldError `json:",omitempty"`
 }
 
-type UploaderQueue struct {
-	File    string
-	RelPath string
-	Conf    DeployConfig
+// sendResponse writes msg as JSON, using its Code as the HTTP status.
+func sendResponse(w http.ResponseWriter, msg APIResponse) {
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	msgToSend, _ := json.Marshal(msg)
+
+	w.WriteHeader(int(msg.Code))
+	w.Write(msgToSend)
 }
 
 var (
-	sitedir  = "sites"
-	gendir   = "_gen"
-	outdir   = "_out"
-	basedir  = ""
-	s3key    = ""
-	s3secret = ""
-	verbose  = true
+	sitedir      = "sites"
+	gendir       = "_gen"
+	outdir       = "_out"
+	deploydir    = "_deploy"
+	releasesdir  = "_releases"
+	buildsdir    = "builds"
+	uploadsdir   = "uploads"
+	basedir      = ""
+	localroot    = ""
+	deployroot   = ""
+	keepReleases = 5
+	s3key        = ""
+	s3secret     = ""
+	verbose      = true
 )
 
 var (
@@ -61,262 +143,307 @@ var (
 	advancedMode    = flag.Bool("multisites", false, "Multistes mode")
 	globalconfS     = flag.String("conf", "jekyll-baas.conf", "Global config file")
 	sitesconfS      = flag.String("sites", "sites.json", "Sites list file")
-	changetoExecDir = flag.Bool("cd", true, "Change to the current directory where the executable is when in single site mode")
+	changetoExecDir = flag.Bool("cd", true, "Use the directory where the executable is as the site source when in single site mode")
 	port            = flag.Int("port", 8080, "Webserver/webservice port")
 	globalconf      string
 	sitesconf       string
 )
 
-func runWithTimeout(cmd *exec.Cmd) {
-	done := make(chan error)
+// runCommand runs the command, copying its output to out (and to the
+// console when verbose), unless its stdout is already taken. The command is
+// killed once ctx is done, in which case the error is ErrTimeout or
+// ErrBuildCanceled; otherwise it is the reason the command failed to run or
+// exited with an error.
+func runCommand(ctx context.Context, cmd *exec.Cmd, out io.Writer) error {
+	stdout := cmd.Stdout == nil
 	if verbose {
-		stderr, _ := cmd.StderrPipe()
-		stdout, _ := cmd.StdoutPipe()
-		go io.Copy(os.Stderr, stderr)
-		go io.Copy(os.Stdout, stdout)
+		// stdout and stderr are copied by separate goroutines
+		out = &lockedWriter{w: out}
+		if stdout {
+			cmd.Stdout = io.MultiWriter(out, os.Stdout)
+		}
+		cmd.Stderr = io.MultiWriter(out, os.Stderr)
+	} else {
+		if stdout {
+			cmd.Stdout = out
+		}
+		cmd.Stderr = out
+	}
+	// Don't wait forever on children that outlive the command and keep its
+	// output open, like ssh for git.
+	cmd.WaitDelay = 10 * time.Second
+
+	fmt.Fprintf(out, "$ %s\n", strings.Join(cmd.Args, " "))
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(out, "Process failed to start: %v\n", err)
+		log.Printf("Process failed to start: %v", err)
+		return err
 	}
-	cmd.Start()
+
+	done := make(chan error, 1)
 	go func() {
 		done <- cmd.Wait()
 	}()
 	select {
-	case <-time.After(60 * time.Second):
+	case <-ctx.Done():
 		if err := cmd.Process.Kill(); err != nil {
-			log.Fatal("Failed to kill: ", err)
+			log.Printf("Failed to kill %s: %v", cmd.Path, err)
 		}
 		<-done // allow goroutine to exit
-		log.Println("Process killed")
+		err := contextError(ctx, ctx.Err())
+		fmt.Fprintf(out, "Process killed: %v\n", err)
+		log.Printf("Process killed: %v", err)
+		return err
 	case err := <-done:
+		if err != nil {
+			fmt.Fprintf(out, "Process done with error = %v\n", err)
+		}
 		log.Printf("Process done with error = %v", err)
+		return err
 	}
 }
 
-func jekyllProcessorConsumer(ch chan SiteConf, configwatcher chan bool) {
-	log.Printf("Site renderer module launching...\n")
+func jekyllProcessorConsumer(worker int, queue *BuildQueue, store SiteStore) {
+	log.Printf("Site renderer module %d launching...\n", worker)
 	for {
-		log.Printf("Waiting for new changes to process...\n")
-
-		job := <-ch
-		log.Printf("--- Got job: %s ---", job.Name)
-
-		src, _ := filepath.Abs(filepath.Join(basedir, sitedir, job.HostName))
-		dest, _ := filepath.Abs(filepath.Join(basedir, gendir, job.HostName))
-		outd, _ := filepath.Abs(filepath.Join(basedir, outdir, job.HostName))
-
-		allsitesdir, _ := filepath.Abs(filepath.Join(basedir, sitedir))
+		log.Printf("[worker %d] Waiting for new changes to process...\n", worker)
 
-		log.Printf("The gen dir is %s out dir is %s", dest, outd)
+		build, ctx := queue.next()
+		log.Printf("[worker %d] --- Got job: %s ---", worker, build)
 
-		// Needs initial deployment
-		if job.NeedsDeployment {
-			log.Printf("Cloning from source...")
-			/*
-				if err := os.MkdirAll(src, 0755); err != nil {
-					log.Printf("Makedir %s error?\n", src)
-					continue
-				}
-			*/
-			os.Chdir(allsitesdir)
-			gitclonecmd := exec.Command("git", "clone", job.CloneURL, job.HostName)
-			runWithTimeout(gitclonecmd)
+		var output bytes.Buffer
+		build.Started = time.Now()
 
+		// Build with the current configuration, not the one the build was
+		// queued with.
+		var err error
+		if site, ok := store.Get(build.HostName); ok {
+			build.Site = site
 		} else {
-
-			log.Printf("Pulling from source...")
-			// Convert the directory to an absolute path
-
-			gitpullcmd := exec.Command("git", "--git-dir="+src+"/.git", "--work-tree="+src, "pull")
-
-			runWithTimeout(gitpullcmd)
+			err = ErrSiteNotFound
 		}
 
-		log.Printf(" Done!\n")
-
-		log.Printf("Generating static site...\n")
-
-		// Change the working directory to the website's source directory
-		os.Chdir(src)
-
-		// Initialize the Jekyll website
-		site, err := NewSite(src, dest)
-		if err != nil {
-			fmt.Printf("Error on site %s while trying to initialize: %v. This site will be temporarily disabled until next tickle!\n", job.Name, err)
-			//os.Exit(1)
-			continue
+		if err == nil {
+			err = runBuild(ctx, build, store, &output, func(phase string) {
+				build.Phase = phase
+				build.Output = output.String()
+				store.SaveBuild(build)
+			})
 		}
 
-		if len(job.BaseURL) != 0 {
-			site.Conf.Set("baseurl", job.BaseURL)
+		build.Finished = time.Now()
+		build.Output = output.String()
+		if ctx.Err() != nil {
+			build.Phase = PhaseCanceled
+			build.Error = ErrBuildCanceled.Error()
+		} else if err != nil {
+			build.Phase = PhaseFailed
+			build.Error = err.Error()
+		} else {
+			build.Phase = PhaseSucceeded
 		}
 
-		// Generate the static website
-		if err := site.Generate(); err != nil {
-			fmt.Printf("Error on site %s while trying to generate static content: %v\n", job.Name, err)
-			//os.Exit(1)
-			continue
+		if err := store.SaveBuild(build); err != nil {
+			fmt.Printf("Error while recording %s: %v\n", build, err)
 		}
 
-		log.Printf(" Done!\n")
-
-		log.Printf("Calculating differences...\n")
-		// Now sync it to the outdir
-
-		// The ending slash makes rsync sync the same level directory
-		rsynccmd := exec.Command("rsync", "--delete", "--size-only", "--recursive", dest+"/", outd)
-
-		runWithTimeout(rsynccmd)
+		queue.done(build)
 
-		log.Printf(" Done!\n")
+		log.Printf("[worker %d] --- Finished %s: %s ---", worker, build, build.Phase)
 	}
 }
 
-func watch(job SiteConf, uploaderqueue chan UploaderQueue) {
+// runBuild syncs the site's source, generates it, stores the result as a new
+// release and deploys what changed, or deploys an old release again for
+// rollbacks and the current one for retries. Command output goes to out,
+// and progress is reported by calling phase as each step starts. Each step
+// is given the time set in the site's Timeouts, and the build stops once
+// ctx is done.
+func runBuild(ctx context.Context, build *Build, store SiteStore, out io.Writer, phase func(string)) error {
+	job := build.Site
+
+	// The host name picks the directories written to below
+	if !isHostName(job.HostName) {
+		return fmt.Errorf("invalid host name %q", job.HostName)
+	}
 
-	// Deploys the static website to S3
-	var conf *DeployConfig
-	// Read the S3 configuration details if there is a s3 conf file
+	src, dest, outd := siteDirs(job.HostName)
 
-	path := filepath.Join(basedir, sitedir, job.HostName, "_jekyll_s3.yml")
+	log.Printf("The gen dir is %s out dir is %s", dest, outd)
 
-	fi, err := os.Stat(path)
-	if fi != nil && err == nil {
-		conf, err = ParseDeployConfig(path)
-		if err != nil {
-			fmt.Printf("Error on site %s while trying to parse deployment config: %v\n", job.Name, err)
-			//os.Exit(1)
-			return
-		}
-	} else {
-		// else use the command line args
-		conf = &DeployConfig{s3key, s3secret, job.HostName}
+	start := func(name string) (context.Context, context.CancelFunc) {
+		phase(name)
+		return phaseContext(ctx, job, name)
 	}
 
-	// Get recursive list of directories to watch
-	src, _ := filepath.Abs(filepath.Join(basedir, outdir, job.HostName))
+	// Retries deploy the current release again, if any
+	if build.Retry {
+		pubCtx, cancel := start(PhasePublishing)
+		defer cancel()
+		if err := retryUploads(pubCtx, build, out); err != nil {
+			fmt.Printf("Error on site %s while trying to retry its uploads: %v\n", job.Name, err)
+			return err
+		}
+		return nil
+	}
 
-	if err := os.MkdirAll(src, 0755); err != nil {
-		log.Printf("Makedir %s error?\n", src)
-		return
+	// Rollbacks only deploy a release again
+	if build.Rollback != "" {
+		pubCtx, cancel := start(PhasePublishing)
+		defer cancel()
+		if err := rollback(pubCtx, build, out); err != nil {
+			fmt.Printf("Error on site %s while trying to roll back: %v\n", job.Name, err)
+			return err
+		}
+		return nil
 	}
 
-	// Setup the inotify watcher
-	watcher, err := fsnotify.NewWatcher()
+	syncCtx, cancel := start(PhaseSyncing)
+	defer cancel()
+
+	fetcher, err := fetcherFor(job.CloneURLType)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+	rev, err := fetcher.Fetch(syncCtx, job, src, out)
+	if err != nil {
+		fmt.Printf("Error on site %s while trying to sync its source: %v\n", job.Name, err)
+		return fmt.Errorf("syncing source: %v", err)
 	}
 
-	log.Printf("[%s] Watching %s\n", job.HostName, src)
-	//os.MkdirAll(src, 0755)
-
-	for _, path := range dirs(src) {
-		if err := watcher.Watch(path); err != nil {
-			fmt.Println(err)
-			return
+	// Record what actually got built, which may be newer than the commit
+	// the build was triggered for.
+	if build.Commit != "" && build.Commit != rev {
+		log.Printf("%s was queued for %s, building %s instead", build, build.Commit, rev)
+	}
+	build.Commit = rev
+
+	// Fetch from now on, once the clone made it
+	if job.NeedsDeployment {
+		_, err := store.Update(job.HostName, func(s *SiteConf) error {
+			// Unless the source was changed again meanwhile
+			if s.CloneURLType == job.CloneURLType && s.CloneURL == job.CloneURL && s.Branch == job.Branch {
+				s.NeedsDeployment = false
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("Error on site %s while trying to save its configuration: %v\n", job.Name, err)
 		}
 	}
 
-	for {
-		select {
-		case ev := <-watcher.Event:
-			// Ignore changes to the _site directoy, hidden, or temp files
-			if !isHiddenOrTemp(ev.Name) && (ev.IsCreate() || ev.IsModify()) {
-				log.Printf("[%s] File created or modified: %s", job.HostName, ev.Name)
-				rel, _ := filepath.Rel(src, ev.Name)
-				uploaderqueue <- UploaderQueue{
-					File:    ev.Name,
-					RelPath: rel,
-					Conf:    *conf,
-				}
-				fi, _ := os.Stat(ev.Name)
-				if fi.IsDir() {
-					log.Printf("[%s] Trying to watch newly created folder: %s", job.HostName, ev.Name)
-					watcher.Watch(ev.Name)
-				}
-			}
+	log.Printf(" Done!\n")
 
-		case err := <-watcher.Error:
-			fmt.Println("inotify error:", err)
-		}
+	genCtx, cancel := start(PhaseGenerating)
+	defer cancel()
+
+	log.Printf("Generating static site...\n")
+
+	root, err := siteRoot(src, job.SourceDir)
+	if err != nil {
+		return err
 	}
-}
 
-func s3uploader(ch chan UploaderQueue) {
-	for {
-		work := <-ch
-		conf := work.Conf
-		fn := work.File
-		rel := work.RelPath
-		auth := aws.Auth{
-			AccessKey: conf.Key,
-			SecretKey: conf.Secret,
-		}
+	if err := generate(genCtx, job, root, dest, out); err != nil {
+		fmt.Printf("Error on site %s while trying to generate static content: %v\n", job.Name, err)
+		return err
+	}
 
-		b := s3.New(auth, aws.USEast).Bucket(conf.Bucket)
+	log.Printf(" Done!\n")
 
-		fi, err := os.Stat(fn)
+	pubCtx, cancel := start(PhasePublishing)
+	defer cancel()
 
-		if err != nil {
-			log.Printf("[s3uploader] There was an error getting the file %s: %v", fn, err)
-			continue
-		}
+	log.Printf("Publishing...\n")
+	if err := publish(pubCtx, build, dest, out); err != nil {
+		fmt.Printf("Error on site %s while trying to publish: %v\n", job.Name, err)
+		return err
+	}
 
-		if fi.IsDir() {
-			continue
-		}
+	log.Printf(" Done!\n")
 
-		log.Printf("[s3uploader] Got file %s, uploading... ", fn)
+	return nil
+}
 
-		typ := mime.TypeByExtension(filepath.Ext(rel))
-		content, err := ioutil.ReadFile(fn)
-		//log.Printf("[s3uploader] Uploading %s...", rel)
-		if err != nil {
-			continue
+// generate generates the site in root into dest, in a sandbox when enabled,
+// until ctx is done.
+func generate(ctx context.Context, job SiteConf, root, dest string, out io.Writer) error {
+	if sandbox.Enabled {
+		if err := generateSandboxed(ctx, root, dest, job.BaseURL, out); err != nil {
+			return fmt.Errorf("generating static content: %v", contextError(ctx, err))
 		}
+		return nil
+	}
 
-		// try to upload the file ... sometimes this fails due to amazon
-		// issues. If so, we'll re-try
-		if err := b.Put(rel, content, typ, s3.PublicRead); err != nil {
-			time.Sleep(100 * time.Millisecond) // sleep so that we don't immediately retry
-			err2 := b.Put(rel, content, typ, s3.PublicRead)
-			if err2 != nil {
-				log.Printf("[s3] Uploading %s... Failed!\n", fn)
-				continue
-			}
-		}
-		log.Printf("[s3] Uploading %s... Success!", fn)
+	// Initialize the Jekyll website
+	site, err := NewSite(root, dest)
+	if err != nil {
+		fmt.Printf("Error on site %s while trying to initialize: %v. This site will be temporarily disabled until next tickle!\n", job.Name, err)
+		//os.Exit(1)
+		return fmt.Errorf("initializing site: %v", err)
+	}
 
+	if len(job.BaseURL) != 0 {
+		site.Conf.Set("baseurl", job.BaseURL)
 	}
+
+	// Generate the static website
+	if err := site.GenerateContext(ctx); err != nil {
+		//os.Exit(1)
+		return fmt.Errorf("generating static content: %v", contextError(ctx, err))
+	}
+	return nil
 }
 
-func configwatch(ch chan bool, allSites *[]SiteConf) {
+// configwatch reloads the sites file on SIGHUP, so it can be edited by hand
+// without restarting. Sites that appeared are built, sites that disappeared
+// are no longer built.
+func configwatch(store SiteStore, queue *BuildQueue) {
 	log.Printf("Sites configuration watcher started.")
-	for {
-		<-ch
-		log.Printf("Saving sites configuration...")
 
-		fi, err := os.Create(sitesconf)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
+	for {
+		<-hup
+		log.Printf("Reloading sites configuration...")
+
+		added, removed, err := store.Reload()
 		if err != nil {
-			log.Printf("FAILED!")
+			log.Printf("FAILED! Keeping the current sites: %v", err)
 			continue
 		}
 
-		b, _ := json.Marshal(allSites)
-		fi.Write(b)
-		//log.Printf("About to write '%s' to %s", string(b), *sitesconf)
-		fi.Close()
+		for _, s := range removed {
+			log.Printf("Site removed: %s [%s]\n", s.Name, s.HostName)
+			queue.Remove(s.HostName)
+		}
+
+		for _, s := range added {
+			log.Printf("Site added: %s [%s]\n", s.Name, s.HostName)
+			startSite(s, store.All(), queue, "reload")
+		}
 	}
 }
 
-var chttp = http.NewServeMux()
-
-func StaticGeneratorHandler(w http.ResponseWriter, r *http.Request) {
-	if strings.Contains(r.URL.Path, ".") {
-		chttp.ServeHTTP(w, r)
-	} else {
-		fmt.Fprintf(w, "StaticGeneratedFilesHandler")
+// startSite builds a site loaded from the sites file, unless its
+// configuration is invalid.
+func startSite(s SiteConf, all []SiteConf, queue *BuildQueue, trigger string) {
+	others := []SiteConf{}
+	for _, o := range all {
+		if o.HostName != s.HostName {
+			others = append(others, o)
+		}
 	}
+	if errs := validateSite(s, others); len(errs) > 0 {
+		log.Printf("Site %s has an invalid configuration and will not be built: %v\n", s.HostName, errs)
+		return
+	}
+
+	queue.Enqueue(NewBuild(s, trigger))
 }
 
 var mu sync.RWMutex
@@ -368,21 +495,26 @@ func simpleWatch(site *Site) {
 }
 
 func main() {
+	// Builds one site, for sandboxed builds
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		os.Exit(buildCommand(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	if *advancedMode == false {
 
+		src, _ := filepath.Abs(".")
 		if *changetoExecDir {
 			oryza_exec, _ := osext.Executable()
-			oryza_dir := filepath.Dir(oryza_exec)
-			log.Printf("Changing current directory to %s\n", oryza_dir)
-			os.Chdir(oryza_dir)
-
+			src = filepath.Dir(oryza_exec)
+			log.Printf("Using %s as the site source\n", src)
 		}
+		dest := filepath.Join(filepath.Dir(src), "_out")
 
 		// Initialize the Jekyll website
-		site, err := NewSite(".", "../_out")
-		os.MkdirAll("../_out", 0755)
+		site, err := NewSite(src, dest)
+		os.MkdirAll(dest, 0755)
 		if err != nil {
 			log.Printf("Error on site while trying to render: %v\n", err)
 			os.Exit(1)
@@ -398,13 +530,11 @@ func main() {
 
 		log.Printf("Check your site at http://127.0.0.1:8080/\n")
 
-		//		chttp.Handle("/", http.FileServer(http.Dir("./_out")))
-
 		// Normal resources
 
 		go simpleWatch(site)
 
-		http.Handle("/", http.FileServer(http.Dir("../_out/")))
+		http.Handle("/", http.FileServer(http.Dir(dest)))
 
 		http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
 
@@ -417,7 +547,6 @@ func main() {
 	log.Printf("Program started with global config file %s, sites %s\n", globalconf, sitesconf)
 
 	c, err := conf.ReadConfigFile(globalconf)
-	allSites := []SiteConf{}
 
 	if err != nil {
 		log.Fatalf("Error while opening global config file: %s. Bailing out!\n", err)
@@ -428,12 +557,71 @@ func main() {
 		port = "9999"
 	}
 
+	// number of sites built concurrently
+	workers, err := c.GetInt("general", "workers")
+	if err != nil || workers < 1 {
+		workers = 2
+	}
+
 	// base dir
 	basedir, err = c.GetString("general", "base_dir")
 	if err != nil {
 		basedir = ""
 	}
 
+	// default time limits of the build phases, in seconds
+	for phase, secs := range map[string]*int{
+		"sync":     &defaultTimeouts.Sync,
+		"generate": &defaultTimeouts.Generate,
+		"publish":  &defaultTimeouts.Publish,
+	} {
+		if n, err := c.GetInt("timeouts", phase); err == nil && n > 0 {
+			*secs = n
+		}
+	}
+
+	// run each build in a child process with resource limits
+	sandbox.Enabled, _ = c.GetBool("sandbox", "enabled")
+	for key, limit := range map[string]*int{
+		"cpu":    &sandbox.CPU,
+		"memory": &sandbox.Memory,
+		"output": &sandbox.Output,
+	} {
+		if n, err := c.GetInt("sandbox", key); err == nil && n >= 0 {
+			*limit = n
+		}
+	}
+
+	// directory holding the sources of "local" sites, disabled when unset
+	if dir, err := c.GetString("sources", "local_root"); err == nil && dir != "" {
+		localroot, _ = filepath.Abs(dir)
+	}
+
+	// directory holding the sites deployed locally, disabled when unset
+	if dir, err := c.GetString("deploy", "local_root"); err == nil && dir != "" {
+		deployroot, _ = filepath.Abs(dir)
+	}
+
+	// how many releases of each site are kept for rollbacks
+	if n, err := c.GetInt("deploy", "releases"); err == nil && n >= 1 {
+		keepReleases = n
+	}
+
+	// how many times failed uploads are tried before giving up on them
+	if n, err := c.GetInt("deploy", "upload_attempts"); err == nil && n >= 1 {
+		maxUploadAttempts = n
+	}
+
+	// how many uploads run at once, all sites together
+	if n, err := c.GetInt("deploy", "uploads"); err == nil && n >= 1 {
+		uploaders = newUploadPool(n)
+	}
+
+	// serve the sites from their current release, by host name, on the port
+	// of the API or one of their own
+	serveEnabled, _ := c.GetBool("serve", "enabled")
+	servePort, _ := c.GetString("serve", "port")
+
 	// s3 access key
 	s3key, err = c.GetString("s3", "key")
 	if err != nil {
@@ -447,109 +635,159 @@ func main() {
 		log.Fatal("No default global S3 secret found. Configure yours in the global config file!\n", err)
 	}
 
-	fi, err := os.Open(sitesconf)
+	// where buckets are, unless the sites say otherwise
+	for key, setting := range map[string]*string{
+		"region":   &s3defaults.Region,
+		"endpoint": &s3defaults.Endpoint,
+		"acl":      &s3defaults.ACL,
+	} {
+		if v, err := c.GetString("s3", key); err == nil && v != "" {
+			*setting = v
+		}
+	}
+	if pathStyle, err := c.GetBool("s3", "path_style"); err == nil {
+		s3defaults.PathStyle = &pathStyle
+	}
 
-	work := make(chan SiteConf)
-	saveConfig := make(chan bool)
-	uploaderqueue := make(chan UploaderQueue)
+	// admin secret guarding site registration
+	adminSecret, err = c.GetString("api", "admin_secret")
+	if err != nil || adminSecret == "" {
+		log.Fatal("No admin API secret found. Configure yours in the global config file!\n", err)
+	}
 
-	go configwatch(saveConfig, &allSites)
+	// key encrypting the deploy keys and access tokens of the sites
+	masterPassphrase, err := c.GetString("secrets", "master_key")
+	if err != nil || masterPassphrase == "" {
+		log.Fatal("No master key found. Configure yours in the global config file!\n", err)
+	}
+	setMasterKey(masterPassphrase)
 
-	go s3uploader(uploaderqueue)
+	log.Printf("Reading all sites configuration... Please wait!\n")
 
-	go jekyllProcessorConsumer(work, saveConfig)
+	// where sites and builds are kept
+	backend, _ := c.GetString("store", "backend")
+	storepath, _ := c.GetString("store", "path")
 
+	store, err := OpenSiteStore(backend, storepath)
 	if err != nil {
 		fmt.Printf("File error while trying to open the sites config: %v\n", err)
 		os.Exit(1)
 	}
+	defer store.Close()
 
-	log.Printf("Reading all sites configuration... Please wait!\n")
-
-	dec := json.NewDecoder(fi)
+	// Start a new database with the sites of the sites file
+	if _, ok := store.(*JSONSiteStore); !ok && len(store.All()) == 0 {
+		if sitesfile, err := OpenJSONSiteStore(sitesconf, filepath.Join(basedir, buildsdir)); err == nil {
+			n, err := importSites(store, sitesfile)
+			log.Printf("Imported %d sites from %s (error = %v)\n", n, sitesconf, err)
+		}
+	}
 
-	if err := dec.Decode(&allSites); err == io.EOF {
+	uploads, err = NewUploadQueue(filepath.Join(basedir, uploadsdir))
+	if err != nil {
+		fmt.Printf("File error while trying to open the upload queue: %v\n", err)
+		os.Exit(1)
+	}
 
-	} else if err != nil {
-		log.Fatal(err)
+	queue := NewBuildQueue(store)
+	for i := 1; i <= workers; i++ {
+		go jekyllProcessorConsumer(i, queue, store)
 	}
 
+	allSites := store.All()
 	for _, s := range allSites {
 		log.Printf("Site: %s [%s]\n", s.Name, s.HostName)
-
-		go watch(s, uploaderqueue)
-		work <- s
+		startSite(s, allSites, queue, "startup")
 	}
 
-	fi.Close()
+	go configwatch(store, queue)
+	go uploadRetrier(store, queue)
+
+	sites := &sitesAPI{
+		sites: store,
+		queue: queue,
+	}
 
 	// Create the handler to serve from the filesystem
 	http.HandleFunc("/update/", func(w http.ResponseWriter, r *http.Request) {
-		hostname := r.URL.Query().Get("hostname")
-		foundhost := false
-		for _, s := range allSites {
-			if s.HostName == hostname {
-				work <- s
-				foundhost = true
-				break
-			}
+		site, _, err := authorizeHost(r, store, r.URL.Query().Get("hostname"), false)
+		if err != nil {
+			authFailed(w, err)
+			return
 		}
 
-		msg := APIResponse{
-			Code:    400,
-			Message: "Command executed successfully",
-		}
+		build, coalesced := queue.Enqueue(NewBuild(site, "api"))
 
-		if !foundhost {
-			msg = APIResponse{
-				Code:    404,
-				Message: "Host not found",
-			}
+		msg := "Build queued"
+		if coalesced {
+			msg = "Build already queued"
 		}
-
-		w.Header().Set("Content-Type", "text/javascript")
-		w.Header().Set("Cache-Control", "no-cache")
-		msgToSend, _ := json.Marshal(msg)
-
-		w.Write(msgToSend)
+		sendResponse(w, APIResponse{
+			Code:    202,
+			Message: msg,
+			Data:    build,
+		})
 	})
 
 	http.HandleFunc("/add/", func(w http.ResponseWriter, r *http.Request) {
-		newUUID, _ := uuid.NewV4()
-		newSite := SiteConf{
-			Name:            r.URL.Query().Get("name"),
-			Email:           r.URL.Query().Get("email"),
-			BaseURL:         r.URL.Query().Get("baseurl"),
-			HostName:        r.URL.Query().Get("hostname"),
-			CloneURLType:    r.URL.Query().Get("clonetype"),
-			CloneURL:        r.URL.Query().Get("cloneurl"),
-			NeedsDeployment: true,
-			APISecret:       newUUID.String(),
+		if err := authorizeAdmin(r); err != nil {
+			authFailed(w, err)
+			return
 		}
 
-		go watch(newSite, uploaderqueue)
-		work <- newSite
-
-		newSite.NeedsDeployment = false
-
-		allSites = append(allSites, newSite)
+		newSite, errs, err := sites.create(SiteConf{
+			Name:         r.URL.Query().Get("name"),
+			Email:        r.URL.Query().Get("email"),
+			BaseURL:      r.URL.Query().Get("baseurl"),
+			HostName:     r.URL.Query().Get("hostname"),
+			CloneURLType: r.URL.Query().Get("clonetype"),
+			CloneURL:     r.URL.Query().Get("cloneurl"),
+			Branch:       r.URL.Query().Get("branch"),
+			SourceDir:    r.URL.Query().Get("sourcedir"),
+			Submodules:   r.URL.Query().Get("submodules") == "true",
+			LFS:          r.URL.Query().Get("lfs") == "true",
+		})
+		if len(errs) > 0 {
+			invalidFields(w, errs)
+			return
+		} else if err != nil {
+			sendResponse(w, APIResponse{
+				Code:    500,
+				Message: fmt.Sprintf("Could not save the site: %v", err),
+			})
+			return
+		}
 
-		msg := APIResponse{
+		sendResponse(w, APIResponse{
 			Code:    200,
 			Message: fmt.Sprintf("%s", newSite.APISecret),
-		}
-
-		w.Header().Set("Content-Type", "text/javascript")
-		w.Header().Set("Cache-Control", "no-cache")
-		msgToSend, _ := json.Marshal(msg)
-
-		saveConfig <- true
-
-		w.Write(msgToSend)
+			Data:    newSite.Redacted(),
+		})
 	})
 
+	http.Handle("/api/sites", sites)
+	http.Handle("/api/sites/", sites)
+	http.HandleFunc("/hook/", hookHandler(store, queue))
+	http.HandleFunc("/builds/", buildHandler(store))
+	http.HandleFunc("/api/builds/", buildsAPIHandler(store, queue))
+	http.HandleFunc("/sites/", siteBuildsHandler(store))
+
+	var handler http.Handler = http.DefaultServeMux
+	if serveEnabled && servePort != "" && servePort != port {
+		sitesHandler := serveSites(store, http.NewServeMux())
+		go func() {
+			fmt.Printf("Serving sites on port %s\n", servePort)
+			if err := http.ListenAndServe(":"+servePort, sitesHandler); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}()
+	} else if serveEnabled {
+		handler = serveSites(store, http.DefaultServeMux)
+	}
+
 	fmt.Printf("Starting server on port %s\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
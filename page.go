@@ -15,9 +15,10 @@ import (
 type Page map[string]interface{}
 
 // ParsePage will parse a file with front-end YAML and markup content, and
-// return a key-value Page structure.
-func ParsePage(fn string) (Page, error) {
-	c, err := ioutil.ReadFile(fn)
+// return a key-value Page structure. The file name fn is relative to the
+// site's source directory root.
+func ParsePage(root, fn string) (Page, error) {
+	c, err := ioutil.ReadFile(filepath.Join(root, fn))
 	if err != nil {
 		return nil, err
 	}
@@ -173,6 +174,24 @@ func (p Page) GetContent() (c string) {
 	return
 }
 
+// Gets the URLs that redirect to this Page, from redirect_from, which holds
+// either one URL or a list of them.
+func (p Page) GetRedirects() (urls []string) {
+	switch v := p["redirect_from"].(type) {
+	case string:
+		urls = append(urls, v)
+	case []string:
+		urls = append(urls, v...)
+	case []interface{}:
+		for _, u := range v {
+			if s, ok := u.(string); ok {
+				urls = append(urls, s)
+			}
+		}
+	}
+	return
+}
+
 // Gets the list of tags to which this Post belongs.
 func (p Page) GetTags() []string {
 	return p.GetStrings("tags")
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// uploadPool bounds how many uploads run at once, across all sites, and
+// shares them fairly: an upload slot that frees up goes to the waiting site
+// with the fewest uploads running, the one that waited longest among equals.
+// A site deploying thousands of files can't keep the others waiting.
+type uploadPool struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	running map[string]int             // Uploads running, by hostname
+	waiting map[string][]chan struct{} // Uploads waiting, by hostname, oldest first
+	order   []string                   // Sites with uploads waiting, longest waiting first
+}
+
+// The upload slots of the deploys, set by uploads in the [deploy] section
+// of the global config file.
+var uploaders = newUploadPool(8)
+
+func newUploadPool(size int) *uploadPool {
+	return &uploadPool{
+		size:    size,
+		running: map[string]int{},
+		waiting: map[string][]chan struct{}{},
+	}
+}
+
+// acquire blocks until the site gets an upload slot, or until ctx is done.
+// Slots acquired must be released.
+func (p *uploadPool) acquire(ctx context.Context, hostname string) error {
+	p.mu.Lock()
+	if p.used < p.size && len(p.order) == 0 {
+		p.used++
+		p.running[hostname]++
+		p.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{}, 1)
+	if len(p.waiting[hostname]) == 0 {
+		p.order = append(p.order, hostname)
+	}
+	p.waiting[hostname] = append(p.waiting[hostname], ch)
+	p.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-ch:
+		// Granted in the meantime, hand it on
+		p.releaseLocked(hostname)
+	default:
+		p.dropWaiter(hostname, ch)
+	}
+	return ctx.Err()
+}
+
+// release gives back a slot of the site.
+func (p *uploadPool) release(hostname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.releaseLocked(hostname)
+}
+
+func (p *uploadPool) releaseLocked(hostname string) {
+	p.used--
+	if p.running[hostname]--; p.running[hostname] <= 0 {
+		delete(p.running, hostname)
+	}
+
+	for p.used < p.size && len(p.order) > 0 {
+		next := 0
+		for i, h := range p.order {
+			if p.running[h] < p.running[p.order[next]] {
+				next = i
+			}
+		}
+		h := p.order[next]
+		p.order = append(p.order[:next], p.order[next+1:]...)
+		ch := p.waiting[h][0]
+		if p.waiting[h] = p.waiting[h][1:]; len(p.waiting[h]) > 0 {
+			// Back in line behind the others
+			p.order = append(p.order, h)
+		} else {
+			delete(p.waiting, h)
+		}
+		p.used++
+		p.running[h]++
+		ch <- struct{}{}
+	}
+}
+
+// Removes a waiting upload of the site, and the site from the line if it
+// has no other.
+func (p *uploadPool) dropWaiter(hostname string, ch chan struct{}) {
+	waiting := p.waiting[hostname]
+	for i, c := range waiting {
+		if c == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) > 0 {
+		p.waiting[hostname] = waiting
+		return
+	}
+	delete(p.waiting, hostname)
+	for i, h := range p.order {
+		if h == hostname {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
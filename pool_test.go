@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUploadPool(t *testing.T) {
+	p := newUploadPool(2)
+	ctx := context.Background()
+
+	// A big site takes every slot, and has more uploads waiting
+	p.acquire(ctx, "big.example.com")
+	p.acquire(ctx, "big.example.com")
+	granted := make(chan string, 3)
+	for _, host := range []string{"big.example.com", "big.example.com", "small.example.com"} {
+		go func(host string) {
+			if err := p.acquire(ctx, host); err == nil {
+				granted <- host
+			}
+		}(host)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The small site goes first, though it came last
+	p.release("big.example.com")
+	got := []string{<-granted}
+	p.release("big.example.com")
+	got = append(got, <-granted)
+	if want := []string{"small.example.com", "big.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected slots to go to %v got %v", want, got)
+	}
+
+	// Waiting stops with the context
+	canceled, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- p.acquire(canceled, "other.example.com") }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+
+	p.release("small.example.com")
+	if host := <-granted; host != "big.example.com" {
+		t.Errorf("Expected the last upload of big.example.com to run got %s", host)
+	}
+	p.release("big.example.com")
+	p.release("big.example.com")
+	if p.used != 0 || len(p.running) != 0 || len(p.waiting) != 0 || len(p.order) != 0 {
+		t.Errorf("Expected the pool to be empty got %+v", p)
+	}
+}
@@ -13,9 +13,10 @@ var (
 )
 
 // ParseParse will parse a file with front-end YAML and markup content, and
-// return a key-value Post structure.
-func ParsePost(fn string) (Page, error) {
-	post, err := ParsePage(fn)
+// return a key-value Post structure. The file name fn is relative to the
+// site's source directory root.
+func ParsePost(root, fn string) (Page, error) {
+	post, err := ParsePage(root, fn)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BuildQueue hands builds to a pool of workers. Different sites build
+// concurrently, but a site never has two builds running at once: a build
+// requested while one is running waits for it to finish.
+//
+// A site has at most one waiting build. Further requests for it are folded
+// into that build, which is then run with the newest configuration and
+// commit information, and builds or rolls back as the newest request says.
+// Retrying the failed uploads of a site is left to the build waiting, if any.
+type BuildQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond                    // Signaled when a build gets ready
+	idle    *sync.Cond                    // Broadcast when a build is done
+	ready   []*Build                      // Waiting builds of idle sites, oldest first
+	pending map[string]*Build             // Waiting build of each site, by hostname
+	running map[string]*Build             // Running build of each site, by hostname
+	cancels map[string]context.CancelFunc // Cancels each running build, by ID
+	store   SiteStore
+}
+
+func NewBuildQueue(store SiteStore) *BuildQueue {
+	q := &BuildQueue{
+		pending: map[string]*Build{},
+		running: map[string]*Build{},
+		cancels: map[string]context.CancelFunc{},
+		store:   store,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.idle = sync.NewCond(&q.mu)
+	return q
+}
+
+// Enqueue records the build and queues it, without blocking on the
+// workers. When the site already has a build waiting, b is merged into it
+// instead; the returned copy is of whichever build will actually run, and
+// coalesced says whether that was an existing one.
+func (q *BuildQueue) Enqueue(b *Build) (queued Build, coalesced bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if p := q.pending[b.HostName]; p != nil {
+		p.Site = b.Site
+		if !b.Retry {
+			// Builds and rollbacks retry the failed uploads too
+			p.Rollback, p.Retry = b.Rollback, false
+		}
+		if b.Commit != "" {
+			p.Ref, p.Commit, p.Pusher = b.Ref, b.Commit, b.Pusher
+		}
+		q.save(p)
+		return *p, true
+	}
+
+	q.pending[b.HostName] = b
+	if q.running[b.HostName] == nil {
+		q.ready = append(q.ready, b)
+		q.cond.Signal()
+	}
+	q.save(b)
+	q.store.PruneBuilds(b.HostName, maxBuildHistory)
+	return *b, false
+}
+
+// next blocks until a build can run, and marks its site as busy. The build
+// should stop once the returned context is done.
+func (q *BuildQueue) next() (*Build, context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.ready) == 0 {
+		q.cond.Wait()
+	}
+
+	b := q.ready[0]
+	q.ready = q.ready[1:]
+	delete(q.pending, b.HostName)
+	q.running[b.HostName] = b
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancels[b.ID] = cancel
+	return b, ctx
+}
+
+// done marks the build's site as idle again, releasing its waiting build,
+// if any.
+func (q *BuildQueue) done(b *Build) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.running, b.HostName)
+	if cancel := q.cancels[b.ID]; cancel != nil {
+		cancel()
+		delete(q.cancels, b.ID)
+	}
+	if p := q.pending[b.HostName]; p != nil {
+		q.ready = append(q.ready, p)
+		q.cond.Signal()
+	}
+	q.idle.Broadcast()
+}
+
+// Running reports whether the site has a build running.
+func (q *BuildQueue) Running(hostname string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running[hostname] != nil
+}
+
+// Remove drops the waiting build of a site, if any, and reports whether the
+// site has a build running.
+func (q *BuildQueue) Remove(hostname string) (running bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.remove(hostname)
+	return q.running[hostname] != nil
+}
+
+// Stop drops the waiting build of a site, if any, and cancels its running
+// one, returning once that has stopped.
+func (q *BuildQueue) Stop(hostname string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		// Builds requested meanwhile are dropped too
+		q.remove(hostname)
+		b := q.running[hostname]
+		if b == nil {
+			return
+		}
+		if cancel := q.cancels[b.ID]; cancel != nil {
+			cancel()
+		}
+		q.idle.Wait()
+	}
+}
+
+// Drops the waiting build of a deleted site.
+func (q *BuildQueue) remove(hostname string) {
+	if p := q.pending[hostname]; p != nil {
+		q.drop(p)
+		p.Phase = PhaseFailed
+		p.Error = "Site was deleted"
+		p.Finished = time.Now()
+		q.save(p)
+	}
+}
+
+// Cancel stops a build: a waiting build is dropped, a running one is told
+// to stop, which it does at its next step. It fails with ErrBuildNotFound if
+// the build is neither waiting nor running.
+func (q *BuildQueue) Cancel(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if cancel := q.cancels[id]; cancel != nil {
+		cancel()
+		return nil
+	}
+	for _, p := range q.pending {
+		if p.ID == id {
+			q.drop(p)
+			p.Phase = PhaseCanceled
+			p.Error = ErrBuildCanceled.Error()
+			p.Finished = time.Now()
+			q.save(p)
+			return nil
+		}
+	}
+	return ErrBuildNotFound
+}
+
+// Removes a waiting build from the queue.
+func (q *BuildQueue) drop(p *Build) {
+	delete(q.pending, p.HostName)
+	for i, b := range q.ready {
+		if b == p {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			break
+		}
+	}
+}
+
+func (q *BuildQueue) save(b *Build) {
+	if err := q.store.SaveBuild(b); err != nil {
+		fmt.Printf("Error while recording %s: %v\n", b, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sitesfile := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(sitesfile, []byte("[]"), 0644)
+	store, err := OpenJSONSiteStore(sitesfile, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewBuildQueue(store)
+
+	a := SiteConf{HostName: "a.example.com"}
+	b := SiteConf{HostName: "b.example.com"}
+
+	first, _ := q.Enqueue(NewBuild(a, "api"))
+	q.Enqueue(NewBuild(b, "api"))
+
+	// Different sites run side by side
+	if running, _ := q.next(); running.ID != first.ID {
+		t.Errorf("Expected build [%s] to run first got [%s]", first.ID, running.ID)
+	}
+	runningB, _ := q.next()
+	if runningB.HostName != b.HostName {
+		t.Errorf("Expected a build of [%s] to run got [%s]", b.HostName, runningB.HostName)
+	}
+
+	// Requests for a busy site wait, and pile up into one build
+	second, coalesced := q.Enqueue(NewBuild(a, "api"))
+	if coalesced {
+		t.Errorf("Expected the first waiting build of a site not to be coalesced")
+	}
+	third := NewBuild(a, "github")
+	third.Commit = "abc123"
+	merged, coalesced := q.Enqueue(third)
+	if !coalesced || merged.ID != second.ID || merged.Commit != "abc123" {
+		t.Errorf("Expected build to be merged into [%s] with commit [abc123] got [%s] [%s]", second.ID, merged.ID, merged.Commit)
+	}
+	if len(q.ready) != 0 {
+		t.Errorf("Expected no build to be ready while its site is busy got %d", len(q.ready))
+	}
+
+	// Retrying uploads is left to the waiting build
+	if merged, _ := q.Enqueue(newRetryBuild(a)); merged.Retry {
+		t.Errorf("Expected the waiting build to stay a build")
+	}
+
+	q.done(&Build{HostName: a.HostName})
+	if running, _ := q.next(); running.ID != second.ID {
+		t.Errorf("Expected build [%s] to run once the site is idle got [%s]", second.ID, running.ID)
+	}
+}
+
+func TestBuildQueueCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sitesfile := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(sitesfile, []byte("[]"), 0644)
+	store, err := OpenJSONSiteStore(sitesfile, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewBuildQueue(store)
+
+	a := SiteConf{HostName: "a.example.com"}
+	first, _ := q.Enqueue(NewBuild(a, "api"))
+	running, ctx := q.next()
+	waiting, _ := q.Enqueue(NewBuild(a, "api"))
+
+	// A running build is told to stop
+	if err := q.Cancel(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() == nil {
+		t.Errorf("Expected the context of a canceled build to be done")
+	}
+
+	// A waiting one never runs
+	if err := q.Cancel(waiting.ID); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := store.GetBuild(waiting.ID); b == nil || b.Phase != PhaseCanceled {
+		t.Errorf("Expected build [%s] to be recorded as canceled got %v", waiting.ID, b)
+	}
+	q.done(running)
+	if len(q.ready) != 0 {
+		t.Errorf("Expected a canceled build not to run got %d ready", len(q.ready))
+	}
+
+	if err := q.Cancel(first.ID); err != ErrBuildNotFound {
+		t.Errorf("Expected [%v] canceling a finished build got [%v]", ErrBuildNotFound, err)
+	}
+}
+
+func TestBuildQueueStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sitesfile := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(sitesfile, []byte("[]"), 0644)
+	store, err := OpenJSONSiteStore(sitesfile, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewBuildQueue(store)
+
+	a := SiteConf{HostName: "a.example.com"}
+	q.Enqueue(NewBuild(a, "api"))
+	running, ctx := q.next()
+	waiting, _ := q.Enqueue(NewBuild(a, "api"))
+
+	// The worker stops once told to
+	go func() {
+		<-ctx.Done()
+		q.done(running)
+	}()
+	q.Stop(a.HostName)
+
+	if q.Running(a.HostName) || len(q.ready) != 0 {
+		t.Errorf("Expected no build of a stopped site got running %v, %d ready", q.Running(a.HostName), len(q.ready))
+	}
+	if b, _ := store.GetBuild(waiting.ID); b == nil || b.Phase != PhaseFailed {
+		t.Errorf("Expected build [%s] to be recorded as failed got %v", waiting.ID, b)
+	}
+}
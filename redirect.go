@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"path"
+	"strings"
+)
+
+// Starts the pages written for redirect_from entries, ahead of the escaped
+// target URL, so deployers can tell them apart.
+const redirectMarker = "<!DOCTYPE html>\n<!-- redirect: "
+
+// Returns a page sending browsers to target, for hosts that can't redirect.
+func redirectPage(target string) []byte {
+	t := html.EscapeString(target)
+	return []byte(fmt.Sprintf(redirectMarker+"%s -->\n"+
+		"<html><head><meta charset=\"utf-8\"><title>Redirecting...</title>\n"+
+		"<link rel=\"canonical\" href=\"%s\">\n"+
+		"<meta http-equiv=\"refresh\" content=\"0; url=%s\">\n"+
+		"</head><body><a href=\"%s\">Click here if you are not redirected.</a></body></html>\n",
+		t, t, t, t))
+}
+
+// Returns the target of a page written by redirectPage, if content is one.
+func redirectTarget(content []byte) (string, bool) {
+	if !bytes.HasPrefix(content, []byte(redirectMarker)) {
+		return "", false
+	}
+	rest := content[len(redirectMarker):]
+	end := bytes.Index(rest, []byte(" -->\n"))
+	if end < 0 {
+		return "", false
+	}
+	return html.UnescapeString(string(rest[:end])), true
+}
+
+// redirectFile returns the file to write for a redirect_from entry of a page,
+// relative to the site root: the entry itself when it names an HTML file, its
+// index.html otherwise. Entries leading out of the site are rejected.
+func redirectFile(from string) (string, error) {
+	p := path.Clean("/" + from)
+	if strings.Contains(from, "..") || strings.ContainsAny(from, "\\\x00") || p == "/" {
+		return "", fmt.Errorf("invalid redirect_from %q", from)
+	}
+	if ext := path.Ext(p); ext != ".html" && ext != ".htm" {
+		p = path.Join(p, "index.html")
+	}
+	return p[1:], nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedirectFile(t *testing.T) {
+	tests := map[string]string{
+		"/old/":           "old/index.html",
+		"old":             "old/index.html",
+		"/2013/post.html": "2013/post.html",
+	}
+	for from, want := range tests {
+		if got, err := redirectFile(from); err != nil || got != want {
+			t.Errorf("Expected %s to give %s got %s (%v)", from, want, got, err)
+		}
+	}
+	for _, from := range []string{"/", "../outside", "a\\b"} {
+		if _, err := redirectFile(from); err == nil {
+			t.Errorf("Expected %s to be rejected", from)
+		}
+	}
+}
+
+func TestRedirectPage(t *testing.T) {
+	target := "/search?q=a&b=\"c\""
+	if got, ok := redirectTarget(redirectPage(target)); !ok || got != target {
+		t.Errorf("Expected the page to redirect to %s got %s", target, got)
+	}
+	if _, ok := redirectTarget([]byte("<!DOCTYPE html>\n<html></html>")); ok {
+		t.Errorf("Expected a plain page not to be a redirect")
+	}
+}
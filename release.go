@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var ErrReleaseNotFound = errors.New("Release not found")
+
+// A Release is the output of a successful build, kept as it was in a
+// directory of its own: {basedir}/_releases/{hostname}/{id}. The output
+// directory of the site is a symbolic link to its current release.
+type Release struct {
+	ID      string
+	Build   string // ID of the build that made it
+	Commit  string // Commit it was generated from, if known
+	Created time.Time
+	Current bool `json:",omitempty"`
+}
+
+// Suffix of the copy of the site's _jekyll_s3.yml kept with each release,
+// next to its record, so that it is deployed where and how it was when
+// made, by rollbacks too. It is empty for the sites without one.
+const deployConfigExt = ".deploy.yml"
+
+// Release IDs are the UTC time they were made at, with a counter for
+// releases made within the same second.
+var releaseID = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z(-[0-9]+)?$`)
+
+// Returns the directory holding the releases of a site.
+func releasesDir(hostname string) string {
+	dir, _ := filepath.Abs(filepath.Join(basedir, releasesdir, hostname))
+	return dir
+}
+
+// currentRelease returns the ID of the release the site's output directory
+// points at, or "" if it has none.
+func currentRelease(hostname string) string {
+	_, _, outd := siteDirs(hostname)
+	return linkedRelease(outd)
+}
+
+// Returns the ID of the release the symbolic link points at, or "".
+func linkedRelease(link string) string {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return ""
+	}
+	id := filepath.Base(target)
+	if !releaseID.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+// newRelease creates a release of the site for the build, starting as a copy
+// of the current release made of hard links, and returns its directory. The
+// files of the new release must be replaced rather than written to.
+func newRelease(ctx context.Context, build *Build) (*Release, string, error) {
+	_, _, outd := siteDirs(build.HostName)
+	id, err := stageRelease(ctx, releasesDir(build.HostName), outd)
+	if err != nil {
+		return nil, "", err
+	}
+	rel := &Release{ID: id, Build: build.ID, Commit: build.Commit, Created: time.Now().UTC()}
+	path := filepath.Join(releasesDir(build.HostName), id)
+
+	data, err := json.MarshalIndent(rel, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path+".json", data, 0644)
+	}
+	if err == nil {
+		err = saveDeployConfig(build, path+deployConfigExt)
+	}
+	if err != nil {
+		removeRelease(build.HostName, rel.ID)
+		return nil, "", err
+	}
+	return rel, path, nil
+}
+
+// Removes a release of the site, its record and its gzipped files.
+func removeRelease(hostname, id string) error {
+	path := filepath.Join(releasesDir(hostname), id)
+	os.Remove(path + ".json")
+	os.Remove(path + deployConfigExt)
+	os.RemoveAll(path + gzipCacheExt)
+	return os.RemoveAll(path)
+}
+
+// getRelease returns the release of the site with the given ID, and its
+// directory.
+func getRelease(hostname, id string) (*Release, string, error) {
+	// IDs come straight from URLs, don't let them escape the directory.
+	if !releaseID.MatchString(id) {
+		return nil, "", ErrReleaseNotFound
+	}
+	path := filepath.Join(releasesDir(hostname), id)
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return nil, "", ErrReleaseNotFound
+	}
+
+	rel := &Release{ID: id}
+	if data, err := ioutil.ReadFile(path + ".json"); err == nil {
+		json.Unmarshal(data, rel)
+	}
+	rel.ID = id
+	rel.Current = id == currentRelease(hostname)
+	return rel, path, nil
+}
+
+// listReleases returns the releases of a site, most recent first.
+func listReleases(hostname string) ([]*Release, error) {
+	files, err := ioutil.ReadDir(releasesDir(hostname))
+	if os.IsNotExist(err) {
+		return []*Release{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, fi := range files {
+		if fi.IsDir() && releaseID.MatchString(fi.Name()) {
+			ids = append(ids, fi.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(byReleaseID(ids)))
+
+	releases := []*Release{}
+	for _, id := range ids {
+		if rel, _, err := getRelease(hostname, id); err == nil {
+			releases = append(releases, rel)
+		}
+	}
+	return releases, nil
+}
+
+// previousRelease returns the ID of the release made before the current one
+// of the site, or "" if there is none.
+func previousRelease(hostname string) string {
+	releases, _ := listReleases(hostname)
+	for i, rel := range releases {
+		if rel.Current && i+1 < len(releases) {
+			return releases[i+1].ID
+		}
+	}
+	return ""
+}
+
+// switchRelease makes the release with the given ID the current one of the
+// site, atomically: readers of the output directory see either the old
+// release or the new one.
+func switchRelease(hostname, id string) error {
+	_, _, outd := siteDirs(hostname)
+	if err := os.MkdirAll(filepath.Dir(outd), 0755); err != nil {
+		return err
+	}
+	return switchLink(outd, filepath.Join(releasesDir(hostname), id))
+}
+
+// pruneReleases removes all but the keep most recent releases of a site,
+// never removing the current one.
+func pruneReleases(hostname string, keep int) error {
+	for _, id := range oldReleases(releasesDir(hostname), currentRelease(hostname), keep) {
+		if err := removeRelease(hostname, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageRelease creates a new release directory in dir, a copy made of hard
+// links of the release the symbolic link points at, and returns its ID. A
+// directory in place of the link, as left by versions without releases, is
+// copied instead.
+func stageRelease(ctx context.Context, dir, link string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	base := time.Now().UTC().Format("20060102T150405Z")
+	id := base
+	for n := 2; ; n++ {
+		err := os.Mkdir(filepath.Join(dir, id), 0755)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	from := ""
+	if cur := linkedRelease(link); cur != "" {
+		from = filepath.Join(dir, cur)
+	} else if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		from = link
+	}
+	if from != "" {
+		if err := linkTree(ctx, from, filepath.Join(dir, id)); err != nil {
+			os.RemoveAll(filepath.Join(dir, id))
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// Returns the IDs of the release directories in dir but the keep most
+// recent ones and current.
+func oldReleases(dir, current string, keep int) []string {
+	files, _ := ioutil.ReadDir(dir)
+	ids := []string{}
+	for _, fi := range files {
+		if fi.IsDir() && releaseID.MatchString(fi.Name()) {
+			ids = append(ids, fi.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(byReleaseID(ids)))
+
+	old := []string{}
+	for i := keep; i < len(ids); i++ {
+		if ids[i] != current {
+			old = append(old, ids[i])
+		}
+	}
+	return old
+}
+
+// Sorts release IDs oldest first: by time, then by counter.
+type byReleaseID []string
+
+func (s byReleaseID) Len() int      { return len(s) }
+func (s byReleaseID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byReleaseID) Less(i, j int) bool {
+	const n = len("20060102T150405Z")
+	if s[i][:n] != s[j][:n] {
+		return s[i][:n] < s[j][:n]
+	}
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) < len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+// switchLink points the symbolic link at target, creating it if needed, by
+// renaming a new link over it. A directory in its way, as left by versions
+// without releases, is removed first.
+func switchLink(link, target string) error {
+	if rel, err := filepath.Rel(filepath.Dir(link), target); err == nil {
+		target = rel
+	}
+	tmp := filepath.Join(filepath.Dir(link), "."+filepath.Base(link)+".link")
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(link); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkTree copies the directory from to the directory to with hard links,
+// or with copies of the files where links can't be made, until ctx is done.
+// Like mirrorDir, symbolic links and special files are skipped.
+func linkTree(ctx context.Context, from, to string) error {
+	return filepath.Walk(from, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return contextError(ctx, err)
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(to, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dest, fi.Mode().Perm()|0700)
+		case !fi.Mode().IsRegular():
+			return nil
+		}
+		if err := os.Link(path, dest); err != nil {
+			return replaceFile(path, dest, fi.Mode().Perm())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+
+	// The output directory of older versions becomes the first release
+	_, _, outd := siteDirs("example.com")
+	writeFiles(t, outd, map[string]string{"index.html": "v0"})
+
+	build := &Build{ID: "b1", HostName: "example.com", Commit: "c1"}
+	ids := []string{}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		rel, path, err := newRelease(context.Background(), build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(path, "index.html")); len(ids) == 0 && string(data) != "v0" {
+			t.Errorf("Expected the release to start from the output directory got [%s]", data)
+		}
+		gen := filepath.Join(dir, "gen")
+		writeFiles(t, gen, map[string]string{"index.html": content})
+		if _, err := mirrorDir(context.Background(), gen, path, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := switchRelease("example.com", rel.ID); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rel.ID)
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(outd, "index.html")); string(data) != "v3" {
+		t.Errorf("Expected the output directory to hold v3 got [%s]", data)
+	}
+	// Releases share the unchanged files, but not the others
+	old, _ := ioutil.ReadFile(filepath.Join(releasesDir("example.com"), ids[0], "index.html"))
+	if string(old) != "v1" {
+		t.Errorf("Expected the first release to still hold v1 got [%s]", old)
+	}
+
+	if prev := previousRelease("example.com"); prev != ids[1] {
+		t.Errorf("Expected the previous release to be %s got %s", ids[1], prev)
+	}
+	if err := switchRelease("example.com", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneReleases("example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+	releases, err := listReleases("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, rel := range releases {
+		got = append(got, rel.ID)
+	}
+	if want := []string{ids[2], ids[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the newest and the current releases to be kept %v got %v", want, got)
+	}
+	if !releases[1].Current || releases[1].Commit != "c1" {
+		t.Errorf("Expected %+v to be current and record its commit", releases[1])
+	}
+
+	if _, _, err := getRelease("example.com", "../../etc"); err != ErrReleaseNotFound {
+		t.Errorf("Expected %v got %v", ErrReleaseNotFound, err)
+	}
+}
+
+func TestReleaseOrder(t *testing.T) {
+	ids := []string{
+		"20261016T120001Z",
+		"20261016T120000Z-10",
+		"20261016T120000Z",
+		"20261016T120000Z-2",
+		"20251231T235959Z",
+	}
+	sort.Sort(byReleaseID(ids))
+	want := []string{
+		"20251231T235959Z",
+		"20261016T120000Z",
+		"20261016T120000Z-2",
+		"20261016T120000Z-10",
+		"20261016T120001Z",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected %v got %v", want, ids)
+	}
+}
+
+func TestReleaseDeployConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+
+	job := SiteConf{HostName: "example.com"}
+	src, _, _ := siteDirs(job.HostName)
+	os.MkdirAll(src, 0755)
+	rel, _, err := newRelease(context.Background(), &Build{ID: "b1", HostName: job.HostName, Site: job})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source deploys elsewhere since, not the release
+	writeFiles(t, src, map[string]string{"_jekyll_s3.yml": "bucket = \"other\"\n"})
+	if conf, err := releaseDeployConfig(job, rel.ID); err != nil || conf.Bucket != job.HostName {
+		t.Errorf("Expected the release to deploy to the bucket [%s] got %+v (%v)", job.HostName, conf, err)
+	}
+	if conf, _ := deployConfig(job); conf.Bucket == job.HostName {
+		t.Errorf("Expected the source to deploy elsewhere got %+v", conf)
+	}
+
+	if err := removeRelease(job.HostName, rel.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(releasesDir(job.HostName), rel.ID+deployConfigExt)); !os.IsNotExist(err) {
+		t.Errorf("Expected the deploy config to go with the release got %v", err)
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"launchpad.net/goamz/aws"
+	"launchpad.net/goamz/s3"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults of the S3 settings of deploy configs, from the [s3] section of the
+// global config file.
+var s3defaults = DeployConfig{Region: "us-east-1", ACL: string(s3.PublicRead)}
+
+// The canned ACLs S3 knows.
+var s3ACLs = []s3.ACL{
+	s3.Private,
+	s3.PublicRead,
+	s3.PublicReadWrite,
+	s3.AuthenticatedRead,
+	s3.BucketOwnerRead,
+	s3.BucketOwnerFull,
+}
+
+// bucket is the part of an S3 bucket the S3 deployer uses.
+type bucket interface {
+	PutReaderHeader(path string, r io.Reader, length int64, customHeaders map[string][]string, perm s3.ACL) error
+	Del(path string) error
+	List(prefix, delim, marker string, max int) (*s3.ListResp, error)
+	initMulti(key string, header http.Header, perm s3.ACL) (multiUpload, error)
+	putWebsite(config []byte) error
+}
+
+// multiUpload is the part of an S3 multipart upload the S3 deployer uses.
+type multiUpload interface {
+	PutAll(r s3.ReaderAtSeeker, partSize int64) ([]s3.Part, error)
+	Complete(parts []s3.Part) error
+	Abort() error
+}
+
+// s3Bucket is a bucket of the S3 API.
+type s3Bucket struct {
+	*s3.Bucket
+}
+
+// initMulti starts a multipart upload of the object with the given headers.
+// goamz's InitMulti only sends the Content-Type, so the request is made
+// here, signed the way goamz signs its own.
+func (b s3Bucket) initMulti(key string, header http.Header, perm s3.ACL) (multiUpload, error) {
+	h := http.Header{}
+	for name, values := range header {
+		h[name] = values
+	}
+	h.Set("X-Amz-Acl", string(perm))
+
+	resp, err := b.request("POST", key, "uploads", h, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadId string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.UploadId == "" {
+		return nil, fmt.Errorf("no upload ID for %s", key)
+	}
+	return &s3.Multi{Bucket: b.Bucket, Key: key, UploadId: result.UploadId}, nil
+}
+
+// putWebsite replaces the website configuration of the bucket, which goamz
+// has no call for.
+func (b s3Bucket) putWebsite(config []byte) error {
+	sum := md5.Sum(config)
+	h := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := b.request("PUT", "", "website", h, config)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// request sends a request for the key, or for its subresource sub when
+// given, with body. Responses other than successes are returned as errors.
+func (b s3Bucket) request(method, key, sub string, header http.Header, body []byte) (*http.Response, error) {
+	path := (&url.URL{Path: "/" + key}).EscapedPath()
+	resource := "/" + b.Bucket.Name + path
+	u := b.S3.Region.S3Endpoint + resource
+	if b.S3.Region.S3BucketEndpoint != "" {
+		u = strings.Replace(b.S3.Region.S3BucketEndpoint, "${bucket}", b.Bucket.Name, -1) + path
+	}
+	if sub != "" {
+		resource += "?" + sub
+		u += "?" + sub
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	sig := s3Signature(b.S3.Auth.SecretKey, method, resource, req.Header)
+	req.Header.Set("Authorization", "AWS "+b.S3.Auth.AccessKey+":"+sig)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(e)
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// s3Signature signs a request to the resource, the path of a bucket and key
+// followed by the subresource if any, with version 2 of S3's signatures.
+func s3Signature(secret, method, resource string, header http.Header) string {
+	amz := []string{}
+	for name, values := range header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			amz = append(amz, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(amz)
+
+	payload := method + "\n" + header.Get("Content-Md5") + "\n" + header.Get("Content-Type") + "\n" + header.Get("Date") + "\n"
+	for _, h := range amz {
+		payload += h + "\n"
+	}
+	payload += resource
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Files larger than multipartThreshold are uploaded in parts of
+// multipartSize, which S3 wants of 5 MB at least.
+var (
+	multipartThreshold int64 = 64 << 20
+	multipartSize      int64 = 16 << 20
+)
+
+// s3Deployer uploads sites to an S3 bucket, or a bucket of a service
+// speaking the S3 API, with keys named after the files' paths and the
+// headers of the deploy config. Redirect pages are uploaded as redirects of
+// the bucket's website.
+//
+// Files are streamed from disk, several at once, each taking a slot of the
+// upload pool for the site.
+//
+// With Releases set in the deploy config, each release goes under a prefix
+// of its own, _releases/{id}/, and is complete once an empty
+// _releases/{id}.complete object is. The bucket's website serves the
+// current one, see websiteConfig.
+type s3Deployer struct {
+	b    bucket
+	acl  s3.ACL
+	conf *DeployConfig
+	site string
+
+	release  string            // Release being staged, if any
+	base     string            // Release its unchanged files are copied from
+	baseSums map[string]string // Keys of that release and their ETag
+}
+
+// Prefix of the keys of the releases.
+const s3Releases = "_releases/"
+
+func newS3Deployer(job SiteConf, conf *DeployConfig) (*s3Deployer, error) {
+	region, err := s3Region(conf)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := s3ACL(conf.ACL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRules(conf); err != nil {
+		return nil, err
+	}
+	auth := aws.Auth{AccessKey: conf.Key, SecretKey: conf.Secret}
+	b := s3Bucket{s3.New(auth, region).Bucket(conf.Bucket)}
+	return &s3Deployer{b: b, acl: acl, conf: conf, site: job.HostName}, nil
+}
+
+// s3Region returns where the bucket of conf is: the AWS region it names,
+// or its endpoint. Buckets are addressed by host name (bucket.endpoint),
+// unless conf asks for path-style addressing (endpoint/bucket), which is
+// also used for bucket names with dots as they don't match the wildcard
+// certificates of the endpoints.
+func s3Region(conf *DeployConfig) (aws.Region, error) {
+	var region aws.Region
+	if conf.Endpoint != "" {
+		u, err := url.Parse(conf.Endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return region, fmt.Errorf("invalid S3 endpoint %q", conf.Endpoint)
+		}
+		region = aws.Region{Name: conf.Region, S3Endpoint: u.Scheme + "://" + u.Host}
+	} else {
+		r, ok := aws.Regions[conf.Region]
+		if !ok {
+			return region, fmt.Errorf("unknown S3 region %q", conf.Region)
+		}
+		region = r
+	}
+
+	region.S3BucketEndpoint = ""
+	if (conf.PathStyle == nil || !*conf.PathStyle) && !strings.Contains(conf.Bucket, ".") {
+		u, err := url.Parse(region.S3Endpoint)
+		if err != nil {
+			return region, err
+		}
+		region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+	return region, nil
+}
+
+// Returns the canned ACL named acl.
+func s3ACL(acl string) (s3.ACL, error) {
+	for _, a := range s3ACLs {
+		if string(a) == acl {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("unknown S3 ACL %q", acl)
+}
+
+func (d *s3Deployer) Put(ctx context.Context, key, file string) error {
+	if err := uploaders.acquire(ctx, d.site); err != nil {
+		return err
+	}
+	defer uploaders.release(d.site)
+
+	o, err := d.object(key, file)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+
+	if sum, ok := d.baseSums[key]; ok {
+		if local, err := o.sum(); err != nil {
+			return err
+		} else if local == sum {
+			return d.copy(key)
+		}
+	}
+
+	key = d.key(key)
+	if !o.multipart() {
+		return d.b.PutReaderHeader(key, o, o.size, o.header, d.acl)
+	}
+	m, err := d.b.initMulti(key, o.header, d.acl)
+	if err != nil {
+		return err
+	}
+	parts, err := m.PutAll(o, multipartSize)
+	if err == nil {
+		err = m.Complete(parts)
+	}
+	if err != nil {
+		m.Abort()
+	}
+	return err
+}
+
+// Copies the object of the base release at key to the staged release,
+// headers and all, within the bucket.
+func (d *s3Deployer) copy(key string) error {
+	src := (&url.URL{Path: "/" + d.conf.Bucket + "/" + s3Releases + d.base + "/" + key}).EscapedPath()
+	h := map[string][]string{
+		"X-Amz-Copy-Source":        {src},
+		"X-Amz-Metadata-Directive": {"COPY"},
+	}
+	return d.b.PutReaderHeader(d.key(key), strings.NewReader(""), 0, h, d.acl)
+}
+
+// Returns the key of the bucket the file deployed as key goes to: key
+// itself, or under the prefix of the release being staged.
+func (d *s3Deployer) key(key string) string {
+	if d.release == "" {
+		return key
+	}
+	return s3Releases + d.release + "/" + key
+}
+
+// Sum returns the ETag the file gets once uploaded: the MD5 hash of the
+// object, or for multipart uploads that of the MD5 hashes of the parts,
+// followed by how many there are.
+func (d *s3Deployer) Sum(key, file string) (string, error) {
+	o, err := d.object(key, file)
+	if err != nil {
+		return "", err
+	}
+	defer o.Close()
+	return o.sum()
+}
+
+// Returns the ETag of the object once uploaded, see Sum, reading it through
+// then back to its start.
+func (o *s3Object) sum() (string, error) {
+	defer o.Seek(0, io.SeekStart)
+	if !o.multipart() {
+		h := md5.New()
+		if _, err := io.Copy(h, o); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	sums := md5.New()
+	n := 0
+	for {
+		h := md5.New()
+		size, err := io.CopyN(h, o, multipartSize)
+		if size > 0 {
+			sums.Write(h.Sum(nil))
+			n++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), n), nil
+}
+
+// An s3Object is what is uploaded for a file: the file itself, or a gzipped
+// copy of it in a temporary file, and its headers.
+type s3Object struct {
+	*os.File
+	size   int64
+	header http.Header
+	temp   bool // Whether the file is a temporary one
+}
+
+// Returns True if the object is uploaded in parts.
+func (o *s3Object) multipart() bool {
+	return o.size > multipartThreshold
+}
+
+func (o *s3Object) Close() error {
+	err := o.File.Close()
+	if o.temp {
+		os.Remove(o.Name())
+	}
+	return err
+}
+
+// Opens the object to upload for the file.
+func (d *s3Deployer) object(key, file string) (*s3Object, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	h, compress := fileHeaders(d.conf, key)
+	o := &s3Object{File: f, header: h}
+
+	// Redirect pages are small, their start tells them apart
+	start := make([]byte, 4096)
+	n, err := io.ReadFull(f, start)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+	if target, ok := redirectTarget(start[:n]); ok && isRedirectLocation(target) {
+		o.header.Set("X-Amz-Website-Redirect-Location", target)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if compress {
+		o.File, err = gzipFile(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		o.temp = true
+	}
+	fi, err := o.Stat()
+	if err != nil {
+		o.Close()
+		return nil, err
+	}
+	o.size = fi.Size()
+	return o, nil
+}
+
+// Returns True if S3 accepts target as the location of a redirect: a path
+// of the bucket or an http(s) URL.
+func isRedirectLocation(target string) bool {
+	return strings.HasPrefix(target, "/") || strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+func (d *s3Deployer) Delete(ctx context.Context, key string) error {
+	return d.remove(ctx, d.key(key))
+}
+
+// List lists the whole bucket, or the release being staged. S3 uses the MD5
+// hash of objects uploaded in one piece as their ETag, and what Sum returns
+// for the others.
+func (d *s3Deployer) List(ctx context.Context) (map[string]string, error) {
+	return d.sums(ctx, d.key(""))
+}
+
+// Returns the keys starting with prefix, without it, and their ETag.
+func (d *s3Deployer) sums(ctx context.Context, prefix string) (map[string]string, error) {
+	keys, _, err := d.list(ctx, prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for _, k := range keys {
+		sums[strings.TrimPrefix(k.Key, prefix)] = strings.Trim(k.ETag, `"`)
+	}
+	return sums, nil
+}
+
+// Lists the keys starting with prefix, page by page. With delim, the keys
+// having it after the prefix are left out, and the prefixes up to it
+// returned instead.
+func (d *s3Deployer) list(ctx context.Context, prefix, delim string) (keys []s3.Key, prefixes []string, err error) {
+	marker := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		resp, err := d.b.List(prefix, delim, marker, 1000)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, resp.Contents...)
+		prefixes = append(prefixes, resp.CommonPrefixes...)
+
+		marker = resp.NextMarker
+		if marker == "" && len(resp.Contents) > 0 {
+			marker = resp.Contents[len(resp.Contents)-1].Key
+		}
+		if !resp.IsTruncated || marker == "" {
+			return keys, prefixes, nil
+		}
+	}
+}
+
+// Finalize marks the release being staged, if any, complete.
+func (d *s3Deployer) Finalize(ctx context.Context) error {
+	if d.release == "" {
+		return nil
+	}
+	return d.b.PutReaderHeader(s3Releases+d.release+".complete", strings.NewReader(""), 0, nil, s3.Private)
+}
+
+// Releases lists the complete releases of the bucket, oldest first.
+func (d *s3Deployer) Releases(ctx context.Context) ([]string, error) {
+	keys, _, err := d.list(ctx, s3Releases, "/")
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, k := range keys {
+		id := strings.TrimSuffix(strings.TrimPrefix(k.Key, s3Releases), ".complete")
+		if strings.HasSuffix(k.Key, ".complete") && releaseID.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(byReleaseID(ids))
+	return ids, nil
+}
+
+func (d *s3Deployer) Stage(ctx context.Context, id, base string) error {
+	d.release, d.base, d.baseSums = id, "", nil
+	if base == "" {
+		return nil
+	}
+	sums, err := d.sums(ctx, s3Releases+base+"/")
+	if err != nil {
+		return err
+	}
+	d.base, d.baseSums = base, sums
+	return nil
+}
+
+// Switch points the bucket's website at the release, then removes the keys
+// deploys without releases left outside of them, which would be served
+// instead of the release's.
+func (d *s3Deployer) Switch(ctx context.Context, id string) error {
+	notFound := s3Releases + id + "/404.html"
+	keys, _, err := d.list(ctx, notFound, "")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || keys[0].Key != notFound {
+		notFound = s3Releases + id + "/"
+	}
+	if err := d.b.putWebsite(websiteConfig(id, notFound)); err != nil {
+		return err
+	}
+
+	keys, prefixes, err := d.list(ctx, "", "/")
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		if prefix == s3Releases {
+			continue
+		}
+		more, _, err := d.list(ctx, prefix, "")
+		if err != nil {
+			return err
+		}
+		keys = append(keys, more...)
+	}
+	for _, k := range keys {
+		if err := d.remove(ctx, k.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveRelease removes the release, its completion mark first.
+func (d *s3Deployer) RemoveRelease(ctx context.Context, id string) error {
+	if err := d.remove(ctx, s3Releases+id+".complete"); err != nil {
+		return err
+	}
+	keys, _, err := d.list(ctx, s3Releases+id+"/", "")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := d.remove(ctx, k.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the key of the bucket, taking a slot of the upload pool.
+func (d *s3Deployer) remove(ctx context.Context, key string) error {
+	if err := uploaders.acquire(ctx, d.site); err != nil {
+		return err
+	}
+	defer uploaders.release(d.site)
+
+	return d.b.Del(key)
+}
+
+// websiteConfig returns the website configuration of a bucket serving the
+// release with the given ID. S3 websites can't be rooted at a prefix, so
+// requests for keys outside of the releases are redirected to the
+// release's, and those for keys missing from the releases to notFound.
+// Missing keys are 403 errors rather than 404 unless anyone may list the
+// bucket, both are redirected.
+func websiteConfig(id, notFound string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<WebsiteConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	b.WriteString(`<IndexDocument><Suffix>index.html</Suffix></IndexDocument><RoutingRules>`)
+	for _, code := range []string{"403", "404"} {
+		fmt.Fprintf(&b, `<RoutingRule><Condition><KeyPrefixEquals>%s</KeyPrefixEquals><HttpErrorCodeReturnedEquals>%s</HttpErrorCodeReturnedEquals></Condition>`, s3Releases, code)
+		fmt.Fprintf(&b, `<Redirect><ReplaceKeyWith>%s</ReplaceKeyWith><HttpRedirectCode>302</HttpRedirectCode></Redirect></RoutingRule>`, notFound)
+	}
+	for _, code := range []string{"403", "404"} {
+		fmt.Fprintf(&b, `<RoutingRule><Condition><HttpErrorCodeReturnedEquals>%s</HttpErrorCodeReturnedEquals></Condition>`, code)
+		fmt.Fprintf(&b, `<Redirect><ReplaceKeyPrefixWith>%s%s/</ReplaceKeyPrefixWith><HttpRedirectCode>302</HttpRedirectCode></Redirect></RoutingRule>`, s3Releases, id)
+	}
+	b.WriteString(`</RoutingRules></WebsiteConfiguration>`)
+	return b.Bytes()
+}
+
+// The S3 deployer's Put and Delete can run side by side.
+func (d *s3Deployer) parallel() {}
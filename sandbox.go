@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bitbucket.org/kardianos/osext"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// SandboxConf limits the resources a sandboxed build may use. Sandboxed
+// builds generate each site in a child process running the build
+// subcommand, so a runaway template or image only takes that process down.
+type SandboxConf struct {
+	Enabled bool
+	CPU     int // CPU time, in seconds
+	Memory  int // Address space, in MB
+	Output  int // Size of the generated site, and of any file in it, in MB
+}
+
+// Sandbox settings, from the [sandbox] section of the global config file.
+var sandbox = SandboxConf{CPU: 300, Memory: 2048, Output: 1024}
+
+// What the build subcommand reports on stdout once done.
+type sandboxReport struct {
+	Error string
+	Pages int   // Pages and posts written
+	Files int   // Static files copied
+	Bytes int64 // Size of the generated site
+}
+
+// generateSandboxed generates the site in root into dest in a child
+// process, within the limits of the sandbox. The child is killed once ctx is
+// done. Its log goes to out.
+func generateSandboxed(ctx context.Context, root, dest, baseurl string, out io.Writer) error {
+	exe, err := osext.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, "build",
+		"-src", root,
+		"-dest", dest,
+		"-baseurl", baseurl,
+		"-cpu", strconv.Itoa(sandbox.CPU),
+		"-memory", strconv.Itoa(sandbox.Memory),
+		"-output", strconv.Itoa(sandbox.Output),
+	)
+	// Keep the service's environment away from the templates
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "TMPDIR=" + os.TempDir()}
+
+	var report bytes.Buffer
+	cmd.Stdout = &report
+	runErr := runCommand(ctx, cmd, out)
+
+	r := sandboxReport{}
+	if err := json.Unmarshal(report.Bytes(), &r); err != nil {
+		// Killed before it could tell, by us or by a limit
+		if runErr != nil {
+			return fmt.Errorf("sandboxed build: %v", runErr)
+		}
+		return fmt.Errorf("sandboxed build sent no report: %v", err)
+	}
+	if r.Error != "" {
+		return fmt.Errorf("%s", r.Error)
+	}
+	if runErr != nil {
+		return runErr
+	}
+
+	fmt.Fprintf(out, "Generated %d pages and %d files, %d bytes\n", r.Pages, r.Files, r.Bytes)
+	return nil
+}
+
+// buildCommand runs the build subcommand: it generates one site within the
+// given limits and reports how it went as JSON on stdout. It returns the
+// exit code.
+func buildCommand(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	src := flags.String("src", "", "Site source directory")
+	dest := flags.String("dest", "", "Directory to generate the site in")
+	baseurl := flags.String("baseurl", "", "Base URL of the site")
+	limits := SandboxConf{}
+	flags.IntVar(&limits.CPU, "cpu", 0, "CPU time limit in seconds, 0 for none")
+	flags.IntVar(&limits.Memory, "memory", 0, "Memory limit in MB, 0 for none")
+	flags.IntVar(&limits.Output, "output", 0, "Output size limit in MB, 0 for none")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Everything but the report goes to stderr
+	log.SetOutput(os.Stderr)
+
+	r := sandboxReport{}
+	if err := setLimits(limits); err != nil {
+		r.Error = fmt.Sprintf("setting resource limits: %v", err)
+	} else if err := buildSite(*src, *dest, *baseurl, limits.Output, &r); err != nil {
+		r.Error = err.Error()
+	}
+	json.NewEncoder(os.Stdout).Encode(r)
+	if r.Error != "" {
+		return 1
+	}
+	return 0
+}
+
+// Generates the site in src into dest, filling in the report, and fails if
+// the result is larger than maxOutput MB.
+func buildSite(src, dest, baseurl string, maxOutput int, r *sandboxReport) error {
+	if src == "" || dest == "" {
+		return fmt.Errorf("-src and -dest are required")
+	}
+
+	site, err := NewSite(src, dest)
+	if err != nil {
+		return fmt.Errorf("initializing site: %v", err)
+	}
+	if baseurl != "" {
+		site.Conf.Set("baseurl", baseurl)
+	}
+	if err := site.Generate(); err != nil {
+		return fmt.Errorf("generating static content: %v", err)
+	}
+	r.Pages = len(site.pages) + len(site.posts)
+	r.Files = len(site.files)
+
+	err = filepath.Walk(dest, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			r.Bytes += fi.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if maxOutput > 0 && r.Bytes > int64(maxOutput)<<20 {
+		return fmt.Errorf("generated site is larger than %d MB", maxOutput)
+	}
+	return nil
+}
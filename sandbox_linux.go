@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+)
+
+// setLimits applies the limits to the current process, to which they stick
+// for good. Zero leaves a limit alone.
+func setLimits(limits SandboxConf) error {
+	for resource, value := range map[int]uint64{
+		syscall.RLIMIT_CPU:   uint64(limits.CPU),
+		syscall.RLIMIT_AS:    uint64(limits.Memory) << 20,
+		syscall.RLIMIT_FSIZE: uint64(limits.Output) << 20,
+	} {
+		if value == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
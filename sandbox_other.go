@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// setLimits fails: there are no resource limits to set on this platform.
+func setLimits(limits SandboxConf) error {
+	if limits.CPU > 0 || limits.Memory > 0 || limits.Output > 0 {
+		return errors.New("resource limits are not supported on this platform")
+	}
+	return nil
+}
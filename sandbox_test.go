@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildSite(t *testing.T) {
+	files := map[string]string{"_config.toml": ""}
+	for fn, content := range fixtures {
+		files[fn] = content
+	}
+	root := writeFixtures(t, files)
+	defer os.RemoveAll(root)
+	dest := filepath.Join(root, "_out")
+
+	r := sandboxReport{}
+	if err := buildSite(root, dest, "", 0, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Pages == 0 || r.Bytes == 0 {
+		t.Errorf("Expected pages and bytes in the report got %+v", r)
+	}
+
+	// Too big a site fails the build
+	files["big.bin"] = strings.Repeat("x", 2<<20)
+	root = writeFixtures(t, files)
+	defer os.RemoveAll(root)
+	if err := buildSite(root, filepath.Join(root, "_out"), "", 1, &sandboxReport{}); err == nil {
+		t.Errorf("Expected a site over the output limit to fail")
+	}
+}
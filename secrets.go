@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	ErrNoMasterKey     = errors.New("No master key configured to encrypt site secrets")
+	ErrSecretCorrupted = errors.New("Site secret could not be decrypted")
+)
+
+// Key encrypting the secrets kept in the site store, derived from
+// master_key in the [secrets] section of the global config file.
+var masterKey []byte
+
+// setMasterKey derives the encryption key from the configured passphrase.
+func setMasterKey(passphrase string) {
+	sum := sha256.Sum256([]byte(passphrase))
+	masterKey = sum[:]
+}
+
+// encryptSecret encrypts a secret of the site hostname with AES-GCM. The
+// host name is authenticated along with it, so a secret copied over to
+// another site won't decrypt.
+func encryptSecret(hostname, plain string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), []byte(hostname))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses encryptSecret.
+func decryptSecret(hostname, enc string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", ErrSecretCorrupted
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(hostname))
+	if err != nil {
+		return "", ErrSecretCorrupted
+	}
+	return string(plain), nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	if masterKey == nil {
+		return nil, ErrNoMasterKey
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDeployKey generates an ed25519 SSH key pair for the site hostname. It
+// returns the private key in OpenSSH format and the public key in
+// authorized_keys format.
+func newDeployKey(hostname string) (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	comment := "jkl-baas@" + hostname
+
+	pubBlob := sshString(nil, []byte("ssh-ed25519"))
+	pubBlob = sshString(pubBlob, pub)
+
+	// Private section, see PROTOCOL.key in the OpenSSH sources
+	check := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, check); err != nil {
+		return "", "", err
+	}
+	block := append(append([]byte{}, check...), check...)
+	block = sshString(block, []byte("ssh-ed25519"))
+	block = sshString(block, pub)
+	block = sshString(block, priv)
+	block = sshString(block, []byte(comment))
+	for i := byte(1); len(block)%8 != 0; i++ {
+		block = append(block, i)
+	}
+
+	key := []byte("openssh-key-v1\x00")
+	key = sshString(key, []byte("none")) // cipher
+	key = sshString(key, []byte("none")) // kdf
+	key = sshString(key, nil)            // kdf options
+	key = binary.BigEndian.AppendUint32(key, 1)
+	key = sshString(key, pubBlob)
+	key = sshString(key, block)
+
+	private = string(pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: key}))
+	public = "ssh-ed25519 " + base64.StdEncoding.EncodeToString(pubBlob) + " " + comment
+	return private, public, nil
+}
+
+// Options making ssh use only the key it is given, and fail rather than
+// prompt.
+const sshOptions = "-o IdentitiesOnly=yes -o IdentityAgent=none -o BatchMode=yes -o StrictHostKeyChecking=accept-new"
+
+// writeDeployKey writes the site's decrypted deploy key to a temporary file
+// for ssh, and returns it along with a function removing it.
+func writeDeployKey(job SiteConf) (file string, cleanup func(), err error) {
+	key, err := decryptSecret(job.HostName, job.DeployKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("deploy key: %v", err)
+	}
+	f, err := ioutil.TempFile("", "jkl-deploy-key-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	_, err = f.WriteString(key)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
+
+// Appends s to b as an SSH wire format string.
+func sshString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
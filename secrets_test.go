@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	defer func(key []byte) { masterKey = key }(masterKey)
+	setMasterKey("test master key")
+
+	enc, err := encryptSecret("a.example.com", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(enc, "s3cret") {
+		t.Errorf("Expected the secret to be encrypted got [%s]", enc)
+	}
+
+	if plain, err := decryptSecret("a.example.com", enc); err != nil || plain != "s3cret" {
+		t.Errorf("Expected [s3cret] got [%s] %v", plain, err)
+	}
+	if _, err := decryptSecret("b.example.com", enc); err != ErrSecretCorrupted {
+		t.Errorf("Expected a secret moved to another site not to decrypt got %v", err)
+	}
+
+	setMasterKey("another master key")
+	if _, err := decryptSecret("a.example.com", enc); err != ErrSecretCorrupted {
+		t.Errorf("Expected a wrong master key to fail got %v", err)
+	}
+}
+
+func TestNewDeployKey(t *testing.T) {
+	private, public, err := newDeployKey("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(public, "ssh-ed25519 ") || !strings.HasSuffix(public, " jkl-baas@a.example.com") {
+		t.Errorf("Expected an ed25519 public key got [%s]", public)
+	}
+
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "jkl-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// OpenSSH must be able to read the private key back
+	keyfile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyfile, []byte(private), 0600)
+	derived, err := exec.Command("ssh-keygen", "-y", "-f", keyfile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newer versions print the comment too
+	if got := strings.Fields(string(derived)); len(got) < 2 || !strings.HasPrefix(public, got[0]+" "+got[1]+" ") {
+		t.Errorf("Expected public key [%s] got [%s]", public, derived)
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	defer func(key []byte) { masterKey = key }(masterKey)
+	setMasterKey("test master key")
+
+	job := SiteConf{HostName: "a.example.com", CloneURL: "http://example.com/blog.git"}
+	sealSecrets(&job, &[]string{"t0ken"}[0], true)
+
+	env, cleanup, err := gitCredentials(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := ""
+	for _, v := range env {
+		if strings.HasPrefix(v, "GIT_CONFIG_") {
+			t.Errorf("Expected no token to be sent over http got [%s]", v)
+		}
+		if strings.HasPrefix(v, "GIT_SSH_COMMAND=") {
+			keyfile = strings.Split(v, "'")[1]
+		}
+	}
+	if fi, err := os.Stat(keyfile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected a private key file readable by us only got %v", err)
+	}
+	cleanup()
+	if _, err := os.Stat(keyfile); !os.IsNotExist(err) {
+		t.Errorf("Expected the key file to be removed")
+	}
+
+	job.CloneURL = "https://example.com/blog.git"
+	env, cleanup, _ = gitCredentials(job)
+	defer cleanup()
+	if !strings.Contains(strings.Join(env, "\n"), "GIT_CONFIG_VALUE_0=Authorization: Basic ") {
+		t.Errorf("Expected the token in an Authorization header got %v", env)
+	}
+	// Submodules on other hosts don't get it
+	if !strings.Contains(strings.Join(env, "\n"), "GIT_CONFIG_KEY_0=http.https://example.com/.extraHeader") {
+		t.Errorf("Expected the header to be sent to example.com only got %v", env)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Files bigger than this are sent as they are, even to clients taking gzip.
+var maxServeGzipSize int64 = 4 << 20
+
+// Suffix of the directory next to a release holding the gzipped copies of its
+// files, made the first time they are asked for.
+const gzipCacheExt = ".gzip"
+
+// siteServer serves the current release of the sites to the requests for
+// their host name, the way S3 website hosting would: /about is looked up as
+// about, about.html, then about/index.html, and the site's 404.html is sent
+// for the files it doesn't have. Requests for other hosts, and for the paths
+// handled by api on any host, go to api.
+type siteServer struct {
+	store SiteStore
+	api   *http.ServeMux
+	gzip  sync.Mutex // Held while gzipping a file into the cache
+}
+
+// serveSites returns a handler serving the sites of the store, and passing
+// requests for unknown hosts and API paths on to api.
+func serveSites(store SiteStore, api *http.ServeMux) http.Handler {
+	return &siteServer{store: store, api: api}
+}
+
+func (s *siteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.store.Get(requestHost(r))
+	if _, pattern := s.api.Handler(r); !ok || (pattern != "" && pattern != "/") {
+		s.api.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Resolved once, so that a release switched meanwhile can't mix files of
+	// two releases into the response
+	_, _, outd := siteDirs(site.HostName)
+	root, err := filepath.EvalSymlinks(outd)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && upath != "/" {
+		upath += "/"
+	}
+	name, redirect := resolvePath(root, upath)
+	if redirect {
+		u := *r.URL
+		u.Path = upath + "/"
+		http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
+	if name == "" {
+		s.serveNotFound(w, r, root)
+		return
+	}
+	// Releases never change, so their files are only gzipped once
+	gzname := ""
+	if dir, err := filepath.EvalSymlinks(releasesDir(site.HostName)); err == nil && filepath.Dir(root) == dir {
+		rel, _ := filepath.Rel(root, name)
+		gzname = filepath.Join(root+gzipCacheExt, rel)
+	}
+	if err := s.serveFile(w, r, name, gzname, http.StatusOK); err != nil {
+		fmt.Printf("Error on site %s while serving %s: %v\n", site.HostName, upath, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Returns the host name of the request, without port and in lower case.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// resolvePath returns the file of the release in root serving upath, or ""
+// if there is none. redirect is set when upath names a directory having an
+// index.html, which should then be asked for with a trailing slash.
+func resolvePath(root, upath string) (name string, redirect bool) {
+	if strings.HasSuffix(upath, "/") {
+		return releaseFile(root, upath+"index.html"), false
+	}
+	for _, p := range []string{upath, upath + ".html"} {
+		if name := releaseFile(root, p); name != "" {
+			return name, false
+		}
+	}
+	return "", releaseFile(root, upath+"/index.html") != ""
+}
+
+// Returns the path of the regular file at upath in root, or "" if there is
+// none. Symbolic links are followed, but not out of root.
+func releaseFile(root, upath string) string {
+	name, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(upath)))
+	if err != nil || !strings.HasPrefix(name, root+string(filepath.Separator)) {
+		return ""
+	}
+	if fi, err := os.Stat(name); err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+	return name
+}
+
+// Sends the site's 404.html with a 404 status, or a plain 404 if it has none.
+func (s *siteServer) serveNotFound(w http.ResponseWriter, r *http.Request, root string) {
+	name := releaseFile(root, "/404.html")
+	if name == "" || s.serveFile(w, r, name, "", http.StatusNotFound) != nil {
+		http.NotFound(w, r)
+	}
+}
+
+// serveFile sends the file with its ETag and Last-Modified. With an OK
+// status, conditional and range requests are answered too, and text gets
+// gzipped for the clients taking it, from its copy at gzname if given.
+func (s *siteServer) serveFile(w http.ResponseWriter, r *http.Request, name, gzname string, status int) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	typ := mime.TypeByExtension(filepath.Ext(name))
+	tag := fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+	compress := isCompressible(typ) && fi.Size() <= maxServeGzipSize
+	if compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	if status != http.StatusOK {
+		if typ != "" {
+			w.Header().Set("Content-Type", typ)
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		w.WriteHeader(status)
+		if r.Method != "HEAD" {
+			io.Copy(w, f)
+		}
+		return nil
+	}
+
+	if !compress || !acceptsGzip(r) {
+		w.Header().Set("ETag", `"`+tag+`"`)
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+		return nil
+	}
+
+	var gz io.ReadSeeker
+	if gzname != "" {
+		f, err := s.gzipped(f, gzname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz = f
+	} else {
+		data, err := gzipData(f)
+		if err != nil {
+			return err
+		}
+		gz = bytes.NewReader(data)
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("ETag", `"`+tag+`-gzip"`)
+	http.ServeContent(w, r, name, fi.ModTime(), gz)
+	return nil
+}
+
+// Opens the gzipped copy of the file at gzname, making it from src first if
+// needed.
+func (s *siteServer) gzipped(src io.Reader, gzname string) (*os.File, error) {
+	if f, err := os.Open(gzname); err == nil {
+		return f, nil
+	}
+
+	s.gzip.Lock()
+	defer s.gzip.Unlock()
+	if f, err := os.Open(gzname); err == nil {
+		return f, nil
+	}
+	data, err := gzipData(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(gzname), 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(gzname, data, 0644); err != nil {
+		return nil, err
+	}
+	return os.Open(gzname)
+}
+
+// Returns the data read from r, gzipped.
+func gzipData(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, r); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns True if files of the media type typ are worth gzipping.
+func isCompressible(typ string) bool {
+	typ, _, err := mime.ParseMediaType(typ)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(typ, "text/") || strings.HasSuffix(typ, "+xml") || strings.HasSuffix(typ, "+json") {
+		return true
+	}
+	switch typ {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// Returns True if the client takes gzipped responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeSites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { basedir = dir }(basedir)
+	basedir = dir
+
+	sitesfile := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(sitesfile, []byte("[]"), 0644)
+	store, err := OpenJSONSiteStore(sitesfile, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(SiteConf{HostName: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	id := "20140101T000000Z"
+	rel := filepath.Join(releasesDir("example.com"), id)
+	page := strings.Repeat("<p>about</p>", 100)
+	writeFiles(t, rel, map[string]string{
+		"index.html":       "home",
+		"about.html":       page,
+		"blog/index.html":  "blog",
+		"404.html":         "not here",
+		"assets/app.png":   "0123456789",
+		"../secret.txt":    "secret",
+		"blog/2014/a.html": "a",
+		"api/index.html":   "shadowed",
+	})
+	if err := switchRelease("example.com", id); err != nil {
+		t.Fatal(err)
+	}
+
+	api := http.NewServeMux()
+	api.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	})
+	server := serveSites(store, api)
+	get := func(host, path string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = host
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := map[string]struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		"index":          {"example.com", "/", 200, "home"},
+		"port and case":  {"Example.COM:8080", "/", 200, "home"},
+		"pretty url":     {"example.com", "/about", 200, page},
+		"file":           {"example.com", "/about.html", 200, page},
+		"directory":      {"example.com", "/blog/", 200, "blog"},
+		"nested":         {"example.com", "/blog/2014/a", 200, "a"},
+		"missing":        {"example.com", "/nope", 404, "not here"},
+		"escape":         {"example.com", "/../secret.txt", 404, "not here"},
+		"other host":     {"api.example.com", "/api/", 200, "api"},
+		"api path":       {"example.com", "/api/", 200, "api"},
+		"directory file": {"example.com", "/assets/", 404, "not here"},
+	}
+	for name, test := range tests {
+		w := get(test.host, test.path, nil)
+		if w.Code != test.code || w.Body.String() != test.body {
+			t.Errorf("%s: Expected %d [%s] got %d [%s]", name, test.code, test.body, w.Code, w.Body.String())
+		}
+	}
+
+	// Directories are asked for with a trailing slash
+	if w := get("example.com", "/blog?page=2", nil); w.Code != 301 || w.Header().Get("Location") != "/blog/?page=2" {
+		t.Errorf("Expected a redirect to /blog/?page=2 got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w := get("example.com", "/assets/app.png", nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("Expected an ETag and a Last-Modified got %v", w.Header())
+	}
+	if w := get("example.com", "/assets/app.png", map[string]string{"If-None-Match": etag}); w.Code != 304 {
+		t.Errorf("Expected 304 got %d", w.Code)
+	}
+	if w := get("example.com", "/assets/app.png", map[string]string{"Range": "bytes=2-4"}); w.Code != 206 || w.Body.String() != "234" {
+		t.Errorf("Expected 206 [234] got %d [%s]", w.Code, w.Body.String())
+	}
+
+	w = get("example.com", "/about", map[string]string{"Accept-Encoding": "deflate, gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected gzipped HTML got %v", w.Header())
+	}
+	if w.Header().Get("ETag") == get("example.com", "/about", nil).Header().Get("ETag") {
+		t.Errorf("Expected the gzipped page to have its own ETag")
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(gz); string(data) != page {
+		t.Errorf("Expected the page got [%s]", data)
+	}
+	cached := filepath.Join(rel+gzipCacheExt, "about.html")
+	data, err := ioutil.ReadFile(cached)
+	if err != nil {
+		t.Errorf("Expected the gzipped page to be kept with the release got %v", err)
+	}
+	if w := get("example.com", "/about", map[string]string{"Accept-Encoding": "gzip"}); w.Body.String() != string(data) {
+		t.Errorf("Expected the kept copy to be sent")
+	}
+	removeRelease("example.com", id)
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("Expected the gzipped copies to go with the release got %v", err)
+	}
+	if w := get("example.com", "/assets/app.png", map[string]string{"Accept-Encoding": "gzip"}); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected images not to be gzipped")
+	}
+	if w := get("example.com", "/about", map[string]string{"Accept-Encoding": "gzip;q=0"}); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no gzip for clients refusing it")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Name of the file kept next to sites deployed over SFTP, listing their
+// files and hashes, as SFTP has no cheap way to tell either.
+const sftpManifest = ".jkl-baas-manifest"
+
+// sftpDeployer uploads sites over SFTP with the sftp command, logging in
+// with the site's deploy key. The URL is sftp://user@host[:port]/path, the
+// path being absolute, or relative to the home directory when it starts with
+// /~/.
+//
+// Changes are queued and sent in one batch by Finalize, along with the
+// updated manifest.
+//
+// With Releases set in the deploy config, each release goes to a directory
+// of its own, .releases/{id} under the path, with its manifest next to it,
+// and is complete once listed in .releases/index. The path's current is a
+// symbolic link to the current release, which the web server should serve.
+type sftpDeployer struct {
+	job    SiteConf
+	target string // user@host
+	port   string
+	root   string // Path of the URL
+	dir    string // Where the files go: root, or the staged release
+	out    io.Writer
+
+	manifest map[string]string // Deployed files and their MD5, once fetched
+	mpath    string            // Where the manifest goes
+	batch    []string          // sftp commands to run
+	mkdirs   map[string]bool   // Directories created by the batch
+	rmdirs   map[string]bool   // Directories of the deleted files, by key
+
+	release  string            // Release being staged, if any
+	base     string            // Directory of the release files are linked from
+	baseSums map[string]string // Files of that release and their MD5
+	index    []string          // Complete releases, once fetched
+
+	// Runs sftp commands, see sftp
+	run func(ctx context.Context, batch []string) error
+}
+
+func newSFTPDeployer(job SiteConf, conf *DeployConfig, out io.Writer) (*sftpDeployer, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || strings.HasPrefix(u.Hostname(), "-") {
+		return nil, fmt.Errorf("invalid SFTP URL %q", conf.URL)
+	}
+	d := &sftpDeployer{
+		job:    job,
+		target: u.Hostname(),
+		port:   u.Port(),
+		dir:    u.Path,
+		out:    out,
+		mkdirs: map[string]bool{},
+		rmdirs: map[string]bool{},
+	}
+	d.run = d.sftp
+	if u.User != nil {
+		d.target = u.User.Username() + "@" + d.target
+	}
+	if d.dir == "/~" || strings.HasPrefix(d.dir, "/~/") {
+		d.dir = strings.TrimPrefix(strings.TrimPrefix(d.dir, "/~"), "/")
+	}
+	d.root = d.dir
+	d.mpath = d.remote(sftpManifest)
+	return d, nil
+}
+
+func (d *sftpDeployer) Put(ctx context.Context, key, file string) error {
+	if err := d.load(ctx); err != nil {
+		return err
+	}
+	sum, err := md5File(file)
+	if err != nil {
+		return err
+	}
+	remote := d.remote(key)
+	var dirs []string
+	for dir := path.Dir(remote); dir != "." && dir != "/" && dir != d.dir && !d.mkdirs[dir]; dir = path.Dir(dir) {
+		d.mkdirs[dir] = true
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d.batch = append(d.batch, "-mkdir "+sftpQuote(dirs[i]))
+	}
+	if d.base != "" && d.baseSums[key] == sum {
+		d.batch = append(d.batch, "ln "+sftpQuote(path.Join(d.base, key))+" "+sftpQuote(remote))
+	} else {
+		d.batch = append(d.batch, "put "+sftpQuote(file)+" "+sftpQuote(remote))
+	}
+	d.manifest[key] = sum
+	return nil
+}
+
+func (d *sftpDeployer) Delete(ctx context.Context, key string) error {
+	if err := d.load(ctx); err != nil {
+		return err
+	}
+	d.batch = append(d.batch, "-rm "+sftpQuote(d.remote(key)))
+	delete(d.manifest, key)
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		d.rmdirs[dir] = true
+	}
+	return nil
+}
+
+// List returns the files of the manifest.
+func (d *sftpDeployer) List(ctx context.Context) (map[string]string, error) {
+	if err := d.load(ctx); err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for key, sum := range d.manifest {
+		sums[key] = sum
+	}
+	return sums, nil
+}
+
+// Finalize sends the changes, and marks the release being staged, if any,
+// complete.
+func (d *sftpDeployer) Finalize(ctx context.Context) error {
+	staged := d.release != "" && !hasRelease(d.index, d.release)
+	if len(d.batch) == 0 && !staged {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range d.manifest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, d.manifest[key]+" "+key)
+	}
+	manifest, err := writeLines(lines)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(manifest)
+
+	batch := []string{}
+	if staged {
+		if d.root != "" {
+			batch = append(batch, "-mkdir "+sftpQuote(d.root))
+		}
+		batch = append(batch, "-mkdir "+sftpQuote(d.releasePath("")))
+	}
+	if d.dir != "" {
+		batch = append(batch, "-mkdir "+sftpQuote(d.dir))
+	}
+	batch = append(batch, d.batch...)
+	for _, dir := range d.emptyDirs() {
+		batch = append(batch, "-rmdir "+sftpQuote(d.remote(dir)))
+	}
+	batch = append(batch, "put "+sftpQuote(manifest)+" "+sftpQuote(d.mpath))
+
+	index := d.index
+	if staged {
+		index = append(append([]string{}, d.index...), d.release)
+		f, err := writeLines(index)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f)
+		batch = append(batch, "put "+sftpQuote(f)+" "+sftpQuote(d.releasePath("index")))
+	}
+	if err := d.run(ctx, batch); err != nil {
+		return err
+	}
+	d.batch, d.index = nil, index
+	d.mkdirs, d.rmdirs = map[string]bool{}, map[string]bool{}
+	return nil
+}
+
+// Releases returns the complete releases, from the index.
+func (d *sftpDeployer) Releases(ctx context.Context) ([]string, error) {
+	if err := d.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return append([]string{}, d.index...), nil
+}
+
+func (d *sftpDeployer) Stage(ctx context.Context, id, base string) error {
+	if err := d.loadIndex(ctx); err != nil {
+		return err
+	}
+	d.release = id
+	d.dir = d.releasePath(id)
+	d.mpath = d.releasePath(id + ".manifest")
+	d.manifest = map[string]string{}
+	d.batch = nil
+	d.mkdirs, d.rmdirs = map[string]bool{}, map[string]bool{}
+	d.base, d.baseSums = "", nil
+	if base == "" {
+		return nil
+	}
+	lines, err := d.fetch(ctx, d.releasePath(base+".manifest"))
+	if err != nil {
+		return err
+	}
+	d.base, d.baseSums = d.releasePath(base), parseManifest(lines)
+	return nil
+}
+
+// Switch points the current link at the release, by renaming a new link
+// over it, which needs the posix-rename extension of OpenSSH servers.
+func (d *sftpDeployer) Switch(ctx context.Context, id string) error {
+	tmp := d.rootPath(".current.tmp")
+	return d.run(ctx, []string{
+		"-rm " + sftpQuote(tmp),
+		"ln -s " + sftpQuote(path.Join(".releases", id)) + " " + sftpQuote(tmp),
+		"rename " + sftpQuote(tmp) + " " + sftpQuote(d.rootPath("current")),
+	})
+}
+
+// RemoveRelease removes the release from the index, then its files and
+// directories, as listed by its manifest.
+func (d *sftpDeployer) RemoveRelease(ctx context.Context, id string) error {
+	if err := d.loadIndex(ctx); err != nil {
+		return err
+	}
+	manifest := d.manifest
+	if id != d.release {
+		lines, err := d.fetch(ctx, d.releasePath(id+".manifest"))
+		if err != nil {
+			return err
+		}
+		manifest = parseManifest(lines)
+	}
+
+	index := []string{}
+	for _, r := range d.index {
+		if r != id {
+			index = append(index, r)
+		}
+	}
+	f, err := writeLines(index)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f)
+
+	dir := d.releasePath(id)
+	batch := []string{"put " + sftpQuote(f) + " " + sftpQuote(d.releasePath("index"))}
+	dirs := map[string]bool{}
+	for key := range manifest {
+		batch = append(batch, "-rm "+sftpQuote(path.Join(dir, key)))
+		for p := path.Dir(key); p != "."; p = path.Dir(p) {
+			dirs[p] = true
+		}
+	}
+	sorted := []string{}
+	for p := range dirs {
+		sorted = append(sorted, p)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	for _, p := range sorted {
+		batch = append(batch, "-rmdir "+sftpQuote(path.Join(dir, p)))
+	}
+	batch = append(batch, "-rm "+sftpQuote(d.releasePath(id+".manifest")), "-rmdir "+sftpQuote(dir))
+	if err := d.run(ctx, batch); err != nil {
+		return err
+	}
+	d.index = index
+	return nil
+}
+
+// Fetches the index of the complete releases, unless it already was.
+func (d *sftpDeployer) loadIndex(ctx context.Context) error {
+	if d.index != nil {
+		return nil
+	}
+	lines, err := d.fetch(ctx, d.releasePath("index"))
+	if err != nil {
+		return err
+	}
+	d.index = []string{}
+	for _, id := range lines {
+		if releaseID.MatchString(id) {
+			d.index = append(d.index, id)
+		}
+	}
+	return nil
+}
+
+// Returns the remote path of name in the directory of the releases.
+func (d *sftpDeployer) releasePath(name string) string {
+	return d.rootPath(path.Join(".releases", name))
+}
+
+// Returns the remote path of name in the directory of the URL.
+func (d *sftpDeployer) rootPath(name string) string {
+	if d.root == "" {
+		return name
+	}
+	return path.Join(d.root, name)
+}
+
+// Writes the lines to a new temporary file, and returns its name.
+func writeLines(lines []string) (string, error) {
+	f, err := ioutil.TempFile("", "jkl-sftp-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Returns the directories of the deleted files that the manifest has no
+// file in anymore, the deepest first.
+func (d *sftpDeployer) emptyDirs() []string {
+	dirs := []string{}
+	for dir := range d.rmdirs {
+		empty := true
+		for key := range d.manifest {
+			if strings.HasPrefix(key, dir+"/") {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			dirs = append(dirs, dir)
+		}
+	}
+	// Subdirectories sort after their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	return dirs
+}
+
+// Fetches the manifest, unless it already was. Sites without one have
+// nothing deployed yet.
+func (d *sftpDeployer) load(ctx context.Context) error {
+	if d.manifest != nil {
+		return nil
+	}
+	lines, err := d.fetch(ctx, d.mpath)
+	if err != nil {
+		return err
+	}
+	d.manifest = parseManifest(lines)
+	return nil
+}
+
+// Returns the files of a manifest and their MD5, by key.
+func parseManifest(lines []string) map[string]string {
+	manifest := map[string]string{}
+	for _, line := range lines {
+		if parts := strings.SplitN(line, " ", 2); len(parts) == 2 && parts[1] != "" {
+			manifest[parts[1]] = parts[0]
+		}
+	}
+	return manifest
+}
+
+// Returns the lines of the remote file, none if there is no such file.
+func (d *sftpDeployer) fetch(ctx context.Context, remote string) ([]string, error) {
+	f, err := ioutil.TempFile("", "jkl-sftp-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := d.run(ctx, []string{"-get " + sftpQuote(remote) + " " + sftpQuote(f.Name())}); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+// Runs the sftp commands in batch mode, stopping at the first that fails
+// unless it starts with "-".
+func (d *sftpDeployer) sftp(ctx context.Context, batch []string) error {
+	f, err := ioutil.TempFile("", "jkl-sftp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(batch, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-b", f.Name()}, strings.Fields(sshOptions)...)
+	if d.job.DeployKey != "" {
+		key, cleanup, err := writeDeployKey(d.job)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		args = append(args, "-i", key)
+	}
+	if d.port != "" {
+		args = append(args, "-P", d.port)
+	}
+	args = append(args, "--", d.target)
+
+	if err := runCommand(ctx, exec.Command("sftp", args...), d.out); err != nil {
+		return fmt.Errorf("sftp: %v", err)
+	}
+	return nil
+}
+
+// Returns the remote path of key.
+func (d *sftpDeployer) remote(key string) string {
+	if d.dir == "" {
+		return key
+	}
+	return path.Join(d.dir, key)
+}
+
+// Quotes s as a single argument of an sftp batch command.
+func sftpQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
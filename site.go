@@ -2,15 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"github.com/nfnt/resize"
 	"image/jpeg"
 	"io/ioutil"
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/s3"
 	"log"
-	"mime"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -38,8 +36,19 @@ type Site struct {
 	templ *template.Template // Compiled templates
 }
 
+// NewSite loads the site in src, to be generated into dest. Both are made
+// absolute, so the site never depends on the process' working directory.
 func NewSite(src, dest string) (*Site, error) {
 
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse the _config.toml file
 	path := filepath.Join(src, "_config.toml")
 	conf, err := ParseConfig(path)
@@ -85,6 +94,12 @@ func (s *Site) Clear() error {
 
 // Generates a static website based on Jekyll standard layout.
 func (s *Site) Generate() error {
+	return s.GenerateContext(context.Background())
+}
+
+// Generates the static website like Generate, giving up with ctx's error
+// once ctx is done.
+func (s *Site) GenerateContext(ctx context.Context) error {
 
 	// Remove previously generated site, and then (re)create the
 	// destination directory
@@ -96,15 +111,19 @@ func (s *Site) Generate() error {
 	}
 
 	// Generate all Pages and Posts and static files
-	if err := s.writePages(); err != nil {
+	if err := s.writePages(ctx); err != nil {
 		return err
 	}
 
-	if err := s.resizeMedia(); err != nil {
+	if err := s.resizeMedia(ctx); err != nil {
 		return err
 	}
 
-	if err := s.writeStatic(); err != nil {
+	if err := s.writeStatic(ctx); err != nil {
+		return err
+	}
+
+	if err := s.writeRedirects(ctx); err != nil {
 		return err
 	}
 
@@ -113,39 +132,6 @@ func (s *Site) Generate() error {
 	return nil
 }
 
-// Deploys a site to S3.
-func (s *Site) Deploy(user, pass, url string) error {
-	auth := aws.Auth{AccessKey: user, SecretKey: pass}
-	b := s3.New(auth, aws.USEast).Bucket(url)
-
-	// walks _site directory and uploads file to S3
-	walker := func(fn string, fi os.FileInfo, err error) error {
-		if fi.IsDir() {
-			return nil
-		}
-
-		rel, _ := filepath.Rel(s.Dest, fn)
-		typ := mime.TypeByExtension(filepath.Ext(rel))
-		content, err := ioutil.ReadFile(fn)
-		log.Printf(MsgUploadFile, rel)
-		if err != nil {
-			return err
-		}
-
-		// try to upload the file ... sometimes this fails due to amazon
-		// issues. If so, we'll re-try
-		if err := b.Put(rel, content, typ, s3.PublicRead); err != nil {
-			time.Sleep(100 * time.Millisecond) // sleep so that we don't immediately retry
-			return b.Put(rel, content, typ, s3.PublicRead)
-		}
-
-		// file upload was a success, return nil
-		return nil
-	}
-
-	return filepath.Walk(s.Dest, walker)
-}
-
 func Filter(s []Page, fn func(Page) bool) []Page {
 	var p []Page // == nil
 	for _, i := range s {
@@ -186,9 +172,9 @@ func (s *Site) read() error {
 			layouts = append(layouts, fn)
 
 		// Parse Posts
-		case isPost(rel):
+		case isPost(s.Src, rel):
 			log.Printf("Processing post %s...", fn)
-			post, err := ParsePost(rel)
+			post, err := ParsePost(s.Src, rel)
 			if err != nil {
 				return err
 			}
@@ -196,9 +182,9 @@ func (s *Site) read() error {
 			s.posts = append([]Page{post}, s.posts...) //s.posts, post)
 
 		// Parse Pages
-		case isPage(rel):
+		case isPage(s.Src, rel):
 			log.Printf("Processing page %s...", fn)
-			page, err := ParsePage(rel)
+			page, err := ParsePage(s.Src, rel)
 			if err != nil {
 				return err
 			}
@@ -292,7 +278,7 @@ func MakeThumb(src string, dst_sane string, dst_thumb string) error {
 
 // Helper function to write all pages and posts to the destination directory
 // during site generation.
-func (s *Site) writePages() error {
+func (s *Site) writePages(ctx context.Context) error {
 
 	// There is really no difference between a Page and a Post (other than
 	// initial parsing) so we can combine the lists and use the same rendering
@@ -302,6 +288,10 @@ func (s *Site) writePages() error {
 	pages = append(pages, s.posts...)
 
 	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		url := page.GetUrl()
 		layout := page.GetLayout()
 
@@ -376,8 +366,43 @@ func (s *Site) writePages() error {
 	return nil
 }
 
+// Helper function to write a page redirecting to each page and post from
+// the URLs in its redirect_from, unless a file is already there.
+func (s *Site) writeRedirects(ctx context.Context) error {
+	baseurl := strings.TrimSuffix(s.Conf.GetString("baseurl"), "/")
+
+	pages := []Page{}
+	pages = append(pages, s.pages...)
+	pages = append(pages, s.posts...)
+
+	for _, page := range pages {
+		for _, from := range page.GetRedirects() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rel, err := redirectFile(from)
+			if err != nil {
+				return fmt.Errorf("%s: %v", page.GetUrl(), err)
+			}
+			f := filepath.Join(s.Dest, filepath.FromSlash(rel))
+			if _, err := os.Stat(f); err == nil {
+				log.Printf("Not redirecting %s to %s: the file exists", rel, page.GetUrl())
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+				return err
+			}
+			target := baseurl + "/" + strings.TrimPrefix(page.GetUrl(), "/")
+			if err := ioutil.WriteFile(f, redirectPage(target), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Helper function to resize the jpegs to sane sizes
-func (s *Site) resizeMedia() error {
+func (s *Site) resizeMedia(ctx context.Context) error {
 
 	os.MkdirAll(filepath.Join(s.Dest, "media"), 0755)
 
@@ -388,6 +413,9 @@ func (s *Site) resizeMedia() error {
 	os.MkdirAll(mediaCacheDir, 0755)
 
 	for i, file := range s.media {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		log.Printf("Automatically resizing media for you (File %d/%d: %s)...\n", i+1, len(s.media), file)
 
 		from := filepath.Join(s.Src, file)
@@ -434,9 +462,12 @@ func (s *Site) resizeMedia() error {
 // Helper function to write all static files to the destination directory
 // during site generation. This will also take care of creating any parent
 // directories, if necessary.
-func (s *Site) writeStatic() error {
+func (s *Site) writeStatic(ctx context.Context) error {
 
 	for _, file := range s.files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		from := filepath.Join(s.Src, file)
 		to := filepath.Join(s.Dest, file)
 		//log.Printf(MsgCopyingFile, file)
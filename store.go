@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SiteStore persists the registered sites and their build history. It is
+// safe for concurrent use. Implementations:
+//
+//   - JSONSiteStore, the sites file plus one JSON file per build
+//   - BoltSiteStore, an embedded BoltDB database holding both
+type SiteStore interface {
+	// All returns every site.
+	All() []SiteConf
+	// Get returns the site configured for hostname.
+	Get(hostname string) (SiteConf, bool)
+	// Add registers a new site, or fails with ErrSiteExists.
+	Add(site SiteConf) error
+	// Update calls fn to change a site, and saves the result unless fn
+	// returns an error. It returns the updated site.
+	Update(hostname string, fn func(*SiteConf) error) (SiteConf, error)
+	// Delete removes a site. Its build history is kept.
+	Delete(hostname string) error
+	// Reload picks up changes made to the store behind our back, and
+	// reports which sites appeared and disappeared.
+	Reload() (added, removed []SiteConf, err error)
+
+	// SaveBuild writes a build record, replacing any previous version.
+	SaveBuild(b *Build) error
+	// GetBuild loads a build record, or fails with ErrBuildNotFound.
+	GetBuild(id string) (*Build, error)
+	// ListBuilds returns the builds of a site, most recent first.
+	ListBuilds(hostname string) ([]*Build, error)
+	// PruneBuilds forgets all but the most recent finished builds of a site.
+	PruneBuilds(hostname string, keep int) error
+
+	Close() error
+}
+
+// OpenSiteStore opens the store backend named in the [store] section of the
+// global config file: "json" (the default) keeps sites in the sites file, and
+// "bolt" in the database file at path, relative to the base directory.
+func OpenSiteStore(backend, path string) (SiteStore, error) {
+	switch backend {
+	case "", "json":
+		return OpenJSONSiteStore(sitesconf, filepath.Join(basedir, buildsdir))
+	case "bolt":
+		if path == "" {
+			path = "jkl-baas.db"
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(basedir, path)
+		}
+		return OpenBoltSiteStore(path)
+	}
+	return nil, fmt.Errorf("unknown site store backend %q", backend)
+}
+
+// importSites copies the sites of one store into another, typically the
+// sites file into a new database. Sites already in dst are left alone.
+func importSites(dst, src SiteStore) (n int, err error) {
+	for _, s := range src.All() {
+		if err := dst.Add(s); err == ErrSiteExists {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	sitesBucket      = []byte("sites")       // hostname -> SiteConf
+	buildsBucket     = []byte("builds")      // build ID -> Build
+	siteBuildsBucket = []byte("site_builds") // hostname -> (queued time + ID -> ID)
+)
+
+// BoltSiteStore keeps sites and builds in an embedded BoltDB database, so
+// lookups stay fast with many tenants and every change is transactional.
+type BoltSiteStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltSiteStore(path string) (*BoltSiteStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sitesBucket, buildsBucket, siteBuildsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltSiteStore{db: db}, nil
+}
+
+func (st *BoltSiteStore) All() []SiteConf {
+	sites := []SiteConf{}
+	err := st.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sitesBucket).ForEach(func(k, v []byte) error {
+			s := SiteConf{}
+			if err := json.Unmarshal(v, &s); err != nil {
+				log.Printf("Skipping unreadable site %s: %v", k, err)
+				return nil
+			}
+			sites = append(sites, s)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Error while listing sites: %v", err)
+	}
+	return sites
+}
+
+func (st *BoltSiteStore) Get(hostname string) (SiteConf, bool) {
+	s := SiteConf{}
+	found := false
+	err := st.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sitesBucket).Get([]byte(hostname))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &s)
+	})
+	if err != nil {
+		log.Printf("Error while reading site %s: %v", hostname, err)
+		return SiteConf{}, false
+	}
+	return s, found
+}
+
+func (st *BoltSiteStore) Add(site SiteConf) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sitesBucket)
+		if b.Get([]byte(site.HostName)) != nil {
+			return ErrSiteExists
+		}
+		return putJSON(b, site.HostName, site)
+	})
+}
+
+func (st *BoltSiteStore) Update(hostname string, fn func(*SiteConf) error) (SiteConf, error) {
+	s := SiteConf{}
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sitesBucket)
+		v := b.Get([]byte(hostname))
+		if v == nil {
+			return ErrSiteNotFound
+		}
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+		s.HostName = hostname
+		return putJSON(b, hostname, s)
+	})
+	if err != nil {
+		return SiteConf{}, err
+	}
+	return s, nil
+}
+
+func (st *BoltSiteStore) Delete(hostname string) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sitesBucket)
+		if b.Get([]byte(hostname)) == nil {
+			return ErrSiteNotFound
+		}
+		return b.Delete([]byte(hostname))
+	})
+}
+
+// Reload has nothing to do: the database is only changed through the store.
+func (st *BoltSiteStore) Reload() (added, removed []SiteConf, err error) {
+	return nil, nil, nil
+}
+
+func (st *BoltSiteStore) SaveBuild(build *Build) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(buildsBucket), build.ID, build); err != nil {
+			return err
+		}
+		index, err := tx.Bucket(siteBuildsBucket).CreateBucketIfNotExists([]byte(build.HostName))
+		if err != nil {
+			return err
+		}
+		return index.Put(buildKey(build), []byte(build.ID))
+	})
+}
+
+func (st *BoltSiteStore) GetBuild(id string) (*Build, error) {
+	build := &Build{}
+	err := st.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(buildsBucket).Get([]byte(id))
+		if v == nil {
+			return ErrBuildNotFound
+		}
+		return json.Unmarshal(v, build)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (st *BoltSiteStore) ListBuilds(hostname string) ([]*Build, error) {
+	builds := []*Build{}
+	err := st.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(siteBuildsBucket).Bucket([]byte(hostname))
+		if index == nil {
+			return nil
+		}
+		all := tx.Bucket(buildsBucket)
+
+		// Keys sort by queue time, walk them backwards for the newest first
+		c := index.Cursor()
+		for k, id := c.Last(); k != nil; k, id = c.Prev() {
+			v := all.Get(id)
+			if v == nil {
+				continue
+			}
+			b := &Build{}
+			if err := json.Unmarshal(v, b); err != nil {
+				continue
+			}
+			builds = append(builds, b)
+		}
+		return nil
+	})
+	return builds, err
+}
+
+func (st *BoltSiteStore) PruneBuilds(hostname string, keep int) error {
+	builds, err := st.ListBuilds(hostname)
+	if err != nil || len(builds) <= keep {
+		return err
+	}
+
+	return st.db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(siteBuildsBucket).Bucket([]byte(hostname))
+		all := tx.Bucket(buildsBucket)
+		for _, b := range builds[keep:] {
+			if !b.Done() {
+				continue
+			}
+			if err := index.Delete(buildKey(b)); err != nil {
+				return err
+			}
+			if err := all.Delete([]byte(b.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (st *BoltSiteStore) Close() error {
+	return st.db.Close()
+}
+
+// buildKey orders a site's builds by the time they were queued.
+func buildKey(b *Build) []byte {
+	key := make([]byte, 8, 8+len(b.ID))
+	binary.BigEndian.PutUint64(key, uint64(b.Queued.UnixNano()))
+	return append(key, b.ID...)
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltSiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenBoltSiteStore(filepath.Join(dir, "jkl-baas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	site := SiteConf{HostName: "blog.example.com", NeedsDeployment: true}
+	if err := store.Add(site); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(site); err != ErrSiteExists {
+		t.Errorf("Expected error [%v] for a duplicate got [%v]", ErrSiteExists, err)
+	}
+
+	store.Update(site.HostName, func(s *SiteConf) error {
+		s.NeedsDeployment = false
+		return nil
+	})
+	if s, ok := store.Get(site.HostName); !ok || s.NeedsDeployment {
+		t.Errorf("Expected NeedsDeployment to be saved as false got %v", s)
+	}
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		b := NewBuild(site, "api")
+		b.Queued = b.Queued.Add(time.Duration(i) * time.Second)
+		b.Phase = PhaseSucceeded
+		if err := store.SaveBuild(b); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, b.ID)
+	}
+
+	if b, err := store.GetBuild(ids[0]); err != nil || b.ID != ids[0] {
+		t.Errorf("Expected to load build [%s] got [%v] with error [%v]", ids[0], b, err)
+	}
+	if _, err := store.GetBuild("nope"); err != ErrBuildNotFound {
+		t.Errorf("Expected error [%v] got [%v]", ErrBuildNotFound, err)
+	}
+
+	store.PruneBuilds(site.HostName, 2)
+	builds, _ := store.ListBuilds(site.HostName)
+	if len(builds) != 2 || builds[0].ID != ids[2] || builds[1].ID != ids[1] {
+		t.Errorf("Expected the 2 most recent builds, newest first, got %v", builds)
+	}
+
+	if err := store.Delete(site.HostName); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.All()) != 0 {
+		t.Errorf("Expected no sites after delete got %v", store.All())
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrSiteExists   = errors.New("Site already registered")
+	ErrSiteNotFound = errors.New("Host not found")
+)
+
+// How many previous versions of the sites file are kept, as sites.json.1
+// (the most recent) to sites.json.N.
+var siteBackups = 5
+
+// JSONSiteStore keeps the sites in the sites file, and their builds in a
+// BuildHistory directory. Every change to a site is written to the sites
+// file before the call returns.
+type JSONSiteStore struct {
+	mu     sync.RWMutex
+	path   string
+	sites  []SiteConf
+	index  map[string]int // Position of each site in sites, by hostname
+	builds *BuildHistory
+}
+
+// OpenJSONSiteStore loads the sites file at path, keeping build records in
+// buildsDir. An empty sites file is an empty store.
+func OpenJSONSiteStore(path, buildsDir string) (*JSONSiteStore, error) {
+	builds, err := NewBuildHistory(buildsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &JSONSiteStore{path: path, builds: builds}
+	sites, err := st.read()
+	if err != nil {
+		return nil, err
+	}
+	st.setSites(sites)
+	return st, nil
+}
+
+// Replaces the sites and rebuilds their index. The caller must hold the
+// write lock.
+func (st *JSONSiteStore) setSites(sites []SiteConf) {
+	st.sites = sites
+	st.index = make(map[string]int, len(sites))
+	for i, s := range sites {
+		st.index[s.HostName] = i
+	}
+}
+
+// Returns the site configured for hostname, or nil. The caller must hold a
+// lock.
+func (st *JSONSiteStore) find(hostname string) *SiteConf {
+	if i, ok := st.index[hostname]; ok {
+		return &st.sites[i]
+	}
+	return nil
+}
+
+// All returns a copy of every site.
+func (st *JSONSiteStore) All() []SiteConf {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return append([]SiteConf{}, st.sites...)
+}
+
+// Get returns the site configured for hostname.
+func (st *JSONSiteStore) Get(hostname string) (SiteConf, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if site := st.find(hostname); site != nil {
+		return *site, true
+	}
+	return SiteConf{}, false
+}
+
+// Add registers a new site.
+func (st *JSONSiteStore) Add(site SiteConf) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.find(site.HostName) != nil {
+		return ErrSiteExists
+	}
+
+	old := st.sites
+	st.setSites(append(append([]SiteConf{}, old...), site))
+	if err := st.save(); err != nil {
+		st.setSites(old)
+		return err
+	}
+	return nil
+}
+
+// Update calls fn to change the site configured for hostname, and saves the
+// result unless fn returns an error. It returns the updated site.
+func (st *JSONSiteStore) Update(hostname string, fn func(*SiteConf) error) (SiteConf, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	site := st.find(hostname)
+	if site == nil {
+		return SiteConf{}, ErrSiteNotFound
+	}
+
+	updated := *site
+	if err := fn(&updated); err != nil {
+		return *site, err
+	}
+	updated.HostName = hostname
+
+	old := *site
+	*site = updated
+	if err := st.save(); err != nil {
+		*site = old
+		return old, err
+	}
+	return updated, nil
+}
+
+// Delete removes the site configured for hostname.
+func (st *JSONSiteStore) Delete(hostname string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i, ok := st.index[hostname]
+	if !ok {
+		return ErrSiteNotFound
+	}
+
+	old := st.sites
+	st.setSites(append(append([]SiteConf{}, old[:i]...), old[i+1:]...))
+	if err := st.save(); err != nil {
+		st.setSites(old)
+		return err
+	}
+	return nil
+}
+
+// Reload re-reads the sites file, typically after it was edited by hand,
+// and reports which sites appeared and disappeared.
+func (st *JSONSiteStore) Reload() (added, removed []SiteConf, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sites, err := st.read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range sites {
+		if st.find(s.HostName) == nil {
+			added = append(added, s)
+		}
+	}
+	for _, s := range st.sites {
+		if findSite(sites, s.HostName) == nil {
+			removed = append(removed, s)
+		}
+	}
+
+	st.setSites(sites)
+	return added, removed, nil
+}
+
+func (st *JSONSiteStore) SaveBuild(b *Build) error {
+	return st.builds.Save(b)
+}
+
+func (st *JSONSiteStore) GetBuild(id string) (*Build, error) {
+	return st.builds.Get(id)
+}
+
+func (st *JSONSiteStore) ListBuilds(hostname string) ([]*Build, error) {
+	return st.builds.List(hostname)
+}
+
+func (st *JSONSiteStore) PruneBuilds(hostname string, keep int) error {
+	return st.builds.Prune(hostname, keep)
+}
+
+// Close has nothing to release, every change is already on disk.
+func (st *JSONSiteStore) Close() error {
+	return nil
+}
+
+func (st *JSONSiteStore) read() ([]SiteConf, error) {
+	sites := []SiteConf{}
+
+	fi, err := os.Open(st.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	if err := json.NewDecoder(fi).Decode(&sites); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading %s: %v", st.path, err)
+	}
+	return sites, nil
+}
+
+// save writes the sites file so that a crash at any point leaves either the
+// old or the new version in place: the new content goes to a temporary
+// file, which is synced and then renamed over the old one. The old version
+// is kept as the first backup. The caller must hold the write lock.
+func (st *JSONSiteStore) save() error {
+	b, err := json.MarshalIndent(st.sites, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(st.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(st.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(st.path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+
+	st.rotateBackups()
+
+	if err := os.Rename(tmp.Name(), st.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts sites.json.1 to sites.json.2 and so on, dropping the
+// oldest, then copies the current sites file to sites.json.1.
+func (st *JSONSiteStore) rotateBackups() {
+	if siteBackups < 1 {
+		return
+	}
+	if _, err := os.Stat(st.path); err != nil {
+		return
+	}
+	for i := siteBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", st.path, i), fmt.Sprintf("%s.%d", st.path, i+1))
+	}
+	if err := copyTo(st.path, st.path+".1"); err != nil {
+		fmt.Printf("Error while backing up %s: %v\n", st.path, err)
+	}
+}
+
+// syncDir flushes a directory entry to disk, so a rename in it survives a
+// crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync() // not supported everywhere, best effort
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONSiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sites.json")
+	ioutil.WriteFile(path, []byte(`[{"HostName":"a.example.com","NeedsDeployment":true}]`), 0644)
+
+	reg, err := OpenJSONSiteStore(path, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Add(SiteConf{HostName: "b.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Add(SiteConf{HostName: "b.example.com"}); err != ErrSiteExists {
+		t.Errorf("Expected error [%v] for a duplicate got [%v]", ErrSiteExists, err)
+	}
+
+	reg.Update("a.example.com", func(s *SiteConf) error {
+		s.NeedsDeployment = false
+		return nil
+	})
+
+	// Every change is on disk straight away
+	saved, err := OpenJSONSiteStore(path, filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := saved.Get("a.example.com"); !ok || a.NeedsDeployment {
+		t.Errorf("Expected NeedsDeployment to be saved as false got %v", a)
+	}
+	if len(saved.All()) != 2 {
+		t.Errorf("Expected 2 saved sites got %d", len(saved.All()))
+	}
+
+	// Previous versions are kept, most recent first
+	backup, err := OpenJSONSiteStore(path+".1", filepath.Join(dir, "builds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := backup.Get("a.example.com"); !ok || !a.NeedsDeployment || len(backup.All()) != 2 {
+		t.Errorf("Expected the backup to hold the previous version got %v", backup.All())
+	}
+
+	if err := reg.Delete("b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand edits show up on reload
+	ioutil.WriteFile(path, []byte(`[{"HostName":"c.example.com"}]`), 0644)
+	added, removed, err := reg.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].HostName != "c.example.com" || len(removed) != 1 || removed[0].HostName != "a.example.com" {
+		t.Errorf("Expected c.example.com added and a.example.com removed got %v and %v", added, removed)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A Changeset lists the files a sync changed, as slash separated paths
+// relative to the synced directory, sorted.
+type Changeset struct {
+	Added    []string
+	Modified []string
+	Deleted  []string
+}
+
+// Returns True if the sync changed nothing.
+func (c Changeset) Empty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Deleted) == 0
+}
+
+func (c Changeset) String() string {
+	return fmt.Sprintf("%d added, %d modified, %d deleted", len(c.Added), len(c.Modified), len(c.Deleted))
+}
+
+// mirrorDir makes the directory to a copy of the directory from, until ctx is
+// done, and returns what it changed. Files are compared by content, and only
+// those that differ are copied; each is written next to its destination and
+// renamed over it, so readers of to never see half a file. Files and
+// directories of to that aren't in from are removed. Like copyTree,
+// symbolic links and special files in from are skipped.
+func mirrorDir(ctx context.Context, from, to string, out io.Writer) (Changeset, error) {
+	changes := Changeset{}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return changes, err
+	}
+
+	// Everything of from that was kept, by relative path
+	keep := map[string]bool{}
+
+	err := filepath.Walk(from, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return contextError(ctx, err)
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		dest := filepath.Join(to, rel)
+
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			fmt.Fprintf(out, "Skipping %s: not a regular file\n", rel)
+			return nil
+		}
+		keep[rel] = true
+
+		// A file where a directory goes, or the other way round, goes first
+		if di, err := os.Lstat(dest); err == nil && di.IsDir() != fi.IsDir() {
+			if err := changes.remove(to, rel); err != nil {
+				return err
+			}
+		}
+
+		if fi.IsDir() {
+			return os.MkdirAll(dest, 0755)
+		}
+		existed, same, err := sameFile(path, dest, fi)
+		if err != nil || same {
+			return err
+		}
+		if err := replaceFile(path, dest, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if existed {
+			changes.Modified = append(changes.Modified, filepath.ToSlash(rel))
+		} else {
+			changes.Added = append(changes.Added, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return changes, err
+	}
+
+	// Remove what's left over from earlier syncs
+	var stale []string
+	err = filepath.Walk(to, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(to, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if keep[rel] {
+			return nil
+		}
+		stale = append(stale, rel)
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return changes, err
+	}
+	for _, rel := range stale {
+		if err := changes.remove(to, rel); err != nil {
+			return changes, err
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Modified)
+	sort.Strings(changes.Deleted)
+	return changes, nil
+}
+
+// Tells whether the file dest exists, and whether it has the same content
+// and permissions as the file path, described by fi.
+func sameFile(path, dest string, fi os.FileInfo) (existed, same bool, err error) {
+	di, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if !di.Mode().IsRegular() || di.Size() != fi.Size() || di.Mode().Perm() != fi.Mode().Perm() {
+		return true, false, nil
+	}
+
+	a, err := hashFile(path)
+	if err != nil {
+		return true, false, err
+	}
+	b, err := hashFile(dest)
+	if err != nil {
+		return true, false, err
+	}
+	return true, bytes.Equal(a, b), nil
+}
+
+// Returns the SHA-256 hash of the file's content.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Copies the file from over the file to, through a temporary file in the
+// same directory.
+func replaceFile(from, to string, perm os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(to), "."+filepath.Base(to)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, in)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Removes rel and everything under it from the directory dir, recording
+// the files removed as deleted.
+func (c *Changeset) remove(dir, rel string) error {
+	path := filepath.Join(dir, rel)
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			r, _ := filepath.Rel(dir, p)
+			c.Deleted = append(c.Deleted, filepath.ToSlash(r))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMirrorDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from, to := filepath.Join(dir, "gen"), filepath.Join(dir, "out")
+
+	writeFiles(t, from, map[string]string{
+		"index.html":      "home",
+		"about.html":      "about",
+		"blog/hello.html": "hello",
+		"blog/bye.html":   "bye",
+		"feed.xml":        "feed",
+	})
+	changes, err := mirrorDir(context.Background(), from, to, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Changeset{Added: []string{"about.html", "blog/bye.html", "blog/hello.html", "feed.xml", "index.html"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %+v got %+v", want, changes)
+	}
+
+	// Same length edit, removed file and directory, file turned directory
+	os.RemoveAll(filepath.Join(from, "blog"))
+	os.Remove(filepath.Join(from, "feed.xml"))
+	writeFiles(t, from, map[string]string{
+		"index.html":         "HOME",
+		"feed.xml/index.xml": "feed",
+	})
+	changes, err = mirrorDir(context.Background(), from, to, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Changeset{
+		Added:    []string{"feed.xml/index.xml"},
+		Modified: []string{"index.html"},
+		Deleted:  []string{"blog/bye.html", "blog/hello.html", "feed.xml"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Expected %+v got %+v", want, changes)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(to, "index.html")); string(b) != "HOME" {
+		t.Errorf("Expected index.html to hold [HOME] got [%s]", b)
+	}
+	if _, err := os.Stat(filepath.Join(to, "blog")); !os.IsNotExist(err) {
+		t.Errorf("Expected blog to be removed got %v", err)
+	}
+
+	// Nothing to do, and nothing left behind by the copies
+	changes, err = mirrorDir(context.Background(), from, to, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Empty() {
+		t.Errorf("Expected no changes got %+v", changes)
+	}
+	names, _ := filepath.Glob(filepath.Join(to, ".*"))
+	if len(names) != 0 {
+		t.Errorf("Expected no temporary files got %v", names)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := mirrorDir(ctx, from, to, ioutil.Discard); err != ErrBuildCanceled {
+		t.Errorf("Expected [%v] got [%v]", ErrBuildCanceled, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrTimeout       = errors.New("Timed out")
+	ErrBuildCanceled = errors.New("Build was canceled")
+)
+
+// PhaseTimeouts limits how long, in seconds, each phase of a build may
+// take. Zero means the default.
+type PhaseTimeouts struct {
+	Sync     int
+	Generate int
+	Publish  int
+}
+
+// Timeouts used when a site sets none, from the [timeouts] section of the
+// global config file.
+var defaultTimeouts = PhaseTimeouts{Sync: 300, Generate: 600, Publish: 300}
+
+// Longest timeout a site may set itself, so one site can't hold a worker
+// for too long.
+const maxPhaseTimeout = 3600
+
+// Returns how long the phase may take, falling back on the defaults for
+// phases without a timeout.
+func (t PhaseTimeouts) get(phase string) time.Duration {
+	var secs, def int
+	switch phase {
+	case PhaseSyncing:
+		secs, def = t.Sync, defaultTimeouts.Sync
+	case PhaseGenerating:
+		secs, def = t.Generate, defaultTimeouts.Generate
+	case PhasePublishing:
+		secs, def = t.Publish, defaultTimeouts.Publish
+	}
+	if secs <= 0 {
+		secs = def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// phaseContext returns the context a phase of the site's build runs in, ending
+// when the phase times out or the build is canceled.
+func phaseContext(ctx context.Context, site SiteConf, phase string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, site.Timeouts.get(phase))
+}
+
+// contextError tells why ctx ended, in the terms of a build, for err caused
+// by it. Other errors are returned as they are.
+func contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return ErrBuildCanceled
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimeouts(t *testing.T) {
+	timeouts := PhaseTimeouts{Generate: 30}
+
+	tests := map[string]time.Duration{
+		PhaseSyncing:    time.Duration(defaultTimeouts.Sync) * time.Second,
+		PhaseGenerating: 30 * time.Second,
+		PhasePublishing: time.Duration(defaultTimeouts.Publish) * time.Second,
+	}
+	for phase, want := range tests {
+		if got := timeouts.get(phase); got != want {
+			t.Errorf("Expected %s to time out after %v got %v", phase, want, got)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not installed")
+	}
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), exec.Command("true"), &out); err != nil {
+		t.Errorf("Expected no error got %v", err)
+	}
+	if err := runCommand(context.Background(), exec.Command("false"), &out); err == nil {
+		t.Errorf("Expected a failing command to return an error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := runCommand(ctx, exec.Command("sleep", "10"), &out); err != ErrTimeout {
+		t.Errorf("Expected [%v] got [%v]", ErrTimeout, err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Expected the command to be killed got it running for %v", took)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := runCommand(ctx, exec.Command("sleep", "10"), &out); err != ErrBuildCanceled {
+		t.Errorf("Expected [%v] got [%v]", ErrBuildCanceled, err)
+	}
+}
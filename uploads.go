@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How many times a failed upload is tried before it is given up on, and how
+// long to wait before the first retry, which doubles after each attempt up
+// to maxUploadRetryDelay.
+var (
+	maxUploadAttempts   = 8
+	uploadRetryDelay    = time.Minute
+	maxUploadRetryDelay = time.Hour
+)
+
+// An Upload is a file of a site that couldn't be deployed, or deleted from
+// the deployment. Retrying it deploys the file of the site's current
+// release, or deletes it if the release doesn't have it anymore.
+type Upload struct {
+	Key      string
+	Attempts int
+	Error    string    // Why the last attempt failed
+	Failed   time.Time // When the first attempt failed
+	Next     time.Time // When it is tried again
+	Dead     bool      // Given up on, until replayed
+}
+
+// Returns True if the upload is to be retried by now.
+func (u *Upload) due(now time.Time) bool {
+	return !u.Dead && !u.Next.After(now)
+}
+
+// UploadQueue persists the failed uploads of each site, one JSON file per
+// site: {dir}/{hostname}.json. Uploads are retried with exponential
+// backoff, until they are given up on after maxUploadAttempts. Those make
+// up the site's dead letters, only retried when replayed, or when a build
+// deploys the file again.
+type UploadQueue struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// The failed uploads of the sites.
+var uploads *UploadQueue
+
+func NewUploadQueue(dir string) (*UploadQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &UploadQueue{dir: dir}, nil
+}
+
+// List returns the failed uploads of a site, sorted by key.
+func (q *UploadQueue) List(hostname string) ([]*Upload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.load(hostname)
+}
+
+// Record updates the uploads of a site after a deploy: the keys of done
+// were deployed, the keys of failed weren't, for the reason given. When all
+// is set, every key of the site was deployed but for failed, which are then
+// all that is left.
+func (q *UploadQueue) Record(hostname string, done []string, failed map[string]error, all bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list, err := q.load(hostname)
+	if err != nil {
+		return err
+	}
+	byKey := map[string]*Upload{}
+	for _, u := range list {
+		byKey[u.Key] = u
+	}
+	if all {
+		for key := range byKey {
+			if failed[key] == nil {
+				delete(byKey, key)
+			}
+		}
+	}
+	for _, key := range done {
+		if failed[key] == nil {
+			delete(byKey, key)
+		}
+	}
+
+	now := time.Now()
+	for key, err := range failed {
+		u := byKey[key]
+		if u == nil {
+			u = &Upload{Key: key, Failed: now}
+			byKey[key] = u
+		}
+		u.Attempts++
+		u.Error = err.Error()
+		u.Next = now.Add(uploadBackoff(u.Attempts))
+		u.Dead = u.Attempts >= maxUploadAttempts
+	}
+
+	list = []*Upload{}
+	for _, u := range byKey {
+		list = append(list, u)
+	}
+	return q.save(hostname, list)
+}
+
+// Replay brings the dead letters of a site back, to be retried at once, and
+// returns how many there were.
+func (q *UploadQueue) Replay(hostname string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list, err := q.load(hostname)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, u := range list {
+		if u.Dead {
+			u.Dead, u.Attempts, u.Next = false, 0, time.Now()
+			n++
+		}
+	}
+	return n, q.save(hostname, list)
+}
+
+// Due returns the sites having uploads to retry by now.
+func (q *UploadQueue) Due(now time.Time) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	hostnames := []string{}
+	for _, f := range files {
+		hostname := filepath.Base(f[:len(f)-len(".json")])
+		list, err := q.load(hostname)
+		if err != nil {
+			continue
+		}
+		for _, u := range list {
+			if u.due(now) {
+				hostnames = append(hostnames, hostname)
+				break
+			}
+		}
+	}
+	return hostnames
+}
+
+// Remove forgets the uploads of a site.
+func (q *UploadQueue) Remove(hostname string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := os.Remove(q.path(hostname))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (q *UploadQueue) path(hostname string) string {
+	return filepath.Join(q.dir, hostname+".json")
+}
+
+func (q *UploadQueue) load(hostname string) ([]*Upload, error) {
+	list := []*Upload{}
+	data, err := ioutil.ReadFile(q.path(hostname))
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Writes the uploads of a site, or removes its file when there are none.
+func (q *UploadQueue) save(hostname string, list []*Upload) error {
+	if len(list) == 0 {
+		err := os.Remove(q.path(hostname))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sort.Sort(uploadsByKey(list))
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(q.path(hostname), data, 0644)
+}
+
+// Returns how long to wait before trying an upload again after its attempts.
+func uploadBackoff(attempts int) time.Duration {
+	d := uploadRetryDelay
+	for i := 1; i < attempts && d < maxUploadRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxUploadRetryDelay {
+		d = maxUploadRetryDelay
+	}
+	return d
+}
+
+// Sorts uploads by key.
+type uploadsByKey []*Upload
+
+func (s uploadsByKey) Len() int           { return len(s) }
+func (s uploadsByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s uploadsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// uploadRetrier queues a retry build for the sites having uploads to retry,
+// checking every minute.
+func uploadRetrier(store SiteStore, queue *BuildQueue) {
+	log.Printf("Upload retrier started.")
+
+	for range time.Tick(time.Minute) {
+		for _, hostname := range uploads.Due(time.Now()) {
+			site, ok := store.Get(hostname)
+			if !ok {
+				uploads.Remove(hostname)
+				continue
+			}
+			queue.Enqueue(newRetryBuild(site))
+		}
+	}
+}
+
+// Returns a build retrying the failed uploads of the site.
+func newRetryBuild(site SiteConf) *Build {
+	b := NewBuild(site, "retry")
+	b.Retry = true
+	return b
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUploadQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jkl-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(n int) { maxUploadAttempts = n }(maxUploadAttempts)
+	maxUploadAttempts = 3
+
+	q, err := NewUploadQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]error{"a.pdf": errors.New("timeout"), "b.pdf": errors.New("timeout")}
+	if err := q.Record("example.com", []string{"index.html"}, failed, false); err != nil {
+		t.Fatal(err)
+	}
+	if due := q.Due(time.Now()); len(due) != 0 {
+		t.Errorf("Expected nothing due before the backoff got %v", due)
+	}
+	if due := q.Due(time.Now().Add(uploadRetryDelay)); len(due) != 1 || due[0] != "example.com" {
+		t.Errorf("Expected example.com to be due got %v", due)
+	}
+
+	// a.pdf made it, b.pdf failed until given up on
+	q.Record("example.com", []string{"a.pdf"}, nil, false)
+	for i := 0; i < 2; i++ {
+		q.Record("example.com", nil, map[string]error{"b.pdf": errors.New("denied")}, false)
+	}
+	list, err := q.List("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Key != "b.pdf" || list[0].Attempts != 3 || !list[0].Dead || list[0].Error != "denied" {
+		t.Fatalf("Expected b.pdf to be a dead letter got %+v", list)
+	}
+	if due := q.Due(time.Now().Add(24 * time.Hour)); len(due) != 0 {
+		t.Errorf("Expected dead letters not to be due got %v", due)
+	}
+
+	if n, err := q.Replay("example.com"); n != 1 || err != nil {
+		t.Errorf("Expected 1 dead letter replayed got %d (%v)", n, err)
+	}
+	if due := q.Due(time.Now()); len(due) != 1 {
+		t.Errorf("Expected the replayed upload to be due got %v", due)
+	}
+
+	// Deploying everything again leaves nothing to retry
+	if err := q.Record("example.com", nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := q.List("example.com"); len(list) != 0 {
+		t.Errorf("Expected no failed uploads got %+v", list)
+	}
+}
+
+func TestUploadBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  uploadRetryDelay,
+		2:  2 * uploadRetryDelay,
+		4:  8 * uploadRetryDelay,
+		20: maxUploadRetryDelay,
+	}
+	for attempts, want := range tests {
+		if got := uploadBackoff(attempts); got != want {
+			t.Errorf("Expected %v after %d attempts got %v", want, attempts, got)
+		}
+	}
+}
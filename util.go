@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	//	"os/exec"
 	//"log"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Appends the extension to the specified file. If the file already has the
@@ -51,6 +53,16 @@ func copyTo(src, dst string) (err error) {
 	return
 }
 
+// writeFileAtomic writes data to the file named path through a temporary
+// file renamed over it, so that readers see the old content or the new, and
+// never half of it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(path+".tmp", data, perm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
 // Returns True if a file has YAML front-end matter.
 func hasMatter(fn string) bool {
 	sample, _ := sniff(fn, 4)
@@ -100,27 +112,29 @@ func isMarkdown(fn string) bool {
 	return false
 }
 
-// Returns True if the specified file is a Page.
-func isPage(fn string) bool {
+// Returns True if the specified file, relative to the source directory
+// root, is a Page.
+func isPage(root, fn string) bool {
 	switch {
 	case strings.HasPrefix(fn, "_"):
 		return false
 	case !isMarkdown(fn) && !isHtml(fn):
 		return false
-	case !hasMatter(fn):
+	case !hasMatter(filepath.Join(root, fn)):
 		return false
 	}
 	return true
 }
 
-// Returns True if the specified file is a Post.
-func isPost(fn string) bool {
+// Returns True if the specified file, relative to the source directory
+// root, is a Post.
+func isPost(root, fn string) bool {
 	switch {
 	case !strings.HasPrefix(fn, "_posts"):
 		return false
 	case !isMarkdown(fn):
 		return false
-	case !hasMatter(fn):
+	case !hasMatter(filepath.Join(root, fn)):
 		return false
 	}
 	return true
@@ -193,3 +207,15 @@ func sniff(fn string, n int) ([]byte, error) {
 
 	return b, nil
 }
+
+// lockedWriter serializes writes to a writer shared by several goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -1,9 +1,36 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
+// Writes a small site source tree to a temporary directory.
+func writeFixtures(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "jkl-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fn, content := range files {
+		path := filepath.Join(root, fn)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var fixtures = map[string]string {
+	"index.html"                      : "---\ntitle = \"Home\"\n---\n<h1>Home</h1>\n",
+	"plain.html"                      : "<h1>No front matter</h1>\n",
+	"about.md"                        : "---\n---\n# About\n",
+	"_posts/2014-01-02-hello.md"      : "---\n---\nHello\n",
+	"_posts/2014-01-03-draft.md"      : "Draft\n",
+	"_layouts/default.html"           : "---\n---\n{{.content}}\n" }
+
 func TestAppendExt(t *testing.T) {
 	if ext := appendExt("/test.html", ".html"); ext != "/test.html" {
 			t.Errorf("Expected appended extension [/test.html] got [%s]", ext)
@@ -14,7 +41,19 @@ func TestAppendExt(t *testing.T) {
 }
 
 func TestHasMatter(t *testing.T) {
-	// TODO
+	root := writeFixtures(t, fixtures)
+	defer os.RemoveAll(root)
+
+	tests := map[string]bool {
+		"index.html" : true,
+		"plain.html" : false,
+		"missing.md" : false }
+
+	for key, val := range tests {
+		if result := hasMatter(filepath.Join(root, key)); result != val {
+			t.Errorf("Expected hasMatter value of [%v] got [%v] for file [%s]", val, result, key)
+		}
+	}
 }
 
 func TestIsHiddenOrTemp(t *testing.T) {
@@ -75,11 +114,37 @@ func TestIsMarkdown(t *testing.T) {
 }
 
 func TestIsPage(t *testing.T) {
-	// TODO
+	root := writeFixtures(t, fixtures)
+	defer os.RemoveAll(root)
+
+	tests := map[string]bool {
+		"index.html"                 : true,
+		"about.md"                   : true,
+		"plain.html"                 : false,
+		"_layouts/default.html"      : false,
+		"_posts/2014-01-02-hello.md" : false }
+
+	for key, val := range tests {
+		if result := isPage(root, key); result != val {
+			t.Errorf("Expected isPage value of [%v] got [%v] for file [%s]", val, result, key)
+		}
+	}
 }
 
 func TestIsPost(t *testing.T) {
-	// TODO
+	root := writeFixtures(t, fixtures)
+	defer os.RemoveAll(root)
+
+	tests := map[string]bool {
+		"_posts/2014-01-02-hello.md" : true,
+		"_posts/2014-01-03-draft.md" : false,
+		"about.md"                   : false }
+
+	for key, val := range tests {
+		if result := isPost(root, key); result != val {
+			t.Errorf("Expected isPost value of [%v] got [%v] for file [%s]", val, result, key)
+		}
+	}
 }
 
 func TestIsStatic(t *testing.T) {
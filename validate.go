@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A FieldError describes why one field of a request was rejected.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+var (
+	// One DNS label: letters, digits and inner hyphens, at most 63 long.
+	dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	// scp-like git address, e.g. git@github.com:user/repo.git
+	scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/-].*$`)
+)
+
+// Supported values of SiteConf.CloneURLType, along with the URL schemes
+// each accepts. Local paths and file:// URLs are deliberately absent: they
+// would let a tenant publish any directory of the server. "local" sources
+// take a path inside the local sources directory instead of a URL.
+var cloneURLSchemes = map[string][]string{
+	"git":     {"https", "http", "git", "ssh"},
+	"hg":      {"https", "http", "ssh"},
+	"archive": {"https", "http"},
+	"local":   nil,
+}
+
+// Source types that have branches.
+var branchTypes = map[string]bool{"git": true, "hg": true}
+
+// normalizeSite fills in defaults and canonical forms before validation.
+func normalizeSite(site *SiteConf) {
+	site.HostName = strings.ToLower(strings.TrimSpace(site.HostName))
+	site.CloneURL = strings.TrimSpace(site.CloneURL)
+	if site.CloneURLType == "local" {
+		site.CloneURL = strings.Trim(filepath.ToSlash(site.CloneURL), "/")
+	}
+	site.Branch = strings.TrimSpace(site.Branch)
+	site.SourceDir = strings.Trim(filepath.ToSlash(strings.TrimSpace(site.SourceDir)), "/")
+	if site.CloneURLType == "" {
+		site.CloneURLType = "git"
+	}
+	if site.Name == "" {
+		site.Name = site.HostName
+	}
+}
+
+// validateSite checks every field of a site configuration and returns one
+// FieldError per invalid field. The host name must not be used by any of the
+// existing sites.
+func validateSite(site SiteConf, existing []SiteConf) []FieldError {
+	errs := []FieldError{}
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case site.HostName == "":
+		add("HostName", "is required")
+	case !isHostName(site.HostName):
+		add("HostName", "%q is not a valid DNS host name", site.HostName)
+	case findSite(existing, site.HostName) != nil:
+		add("HostName", "%q is already registered", site.HostName)
+	}
+
+	local := site.CloneURLType == "local"
+	schemes, ok := cloneURLSchemes[site.CloneURLType]
+	switch {
+	case !ok:
+		add("CloneURLType", "%q is not a supported source type", site.CloneURLType)
+	case local && localroot == "":
+		add("CloneURLType", "local sources are not enabled on this server")
+	}
+
+	switch {
+	case site.CloneURL == "":
+		add("CloneURL", "is required")
+	case local && !isSourceDir(site.CloneURL):
+		add("CloneURL", "%q must be a directory inside the local sources directory", site.CloneURL)
+	case ok && !local && !isCloneURL(site.CloneURL, schemes):
+		add("CloneURL", "must be a URL using one of %s", strings.Join(schemes, ", "))
+	}
+
+	switch {
+	case site.Branch == "":
+	case ok && !branchTypes[site.CloneURLType]:
+		add("Branch", "is not used by %s sources", site.CloneURLType)
+	case !isRefName(site.Branch):
+		add("Branch", "%q is not a valid branch name", site.Branch)
+	}
+
+	if site.SourceDir != "" && !isSourceDir(site.SourceDir) {
+		add("SourceDir", "%q must be a directory inside the repository", site.SourceDir)
+	}
+
+	if site.Submodules && site.CloneURLType != "git" {
+		add("Submodules", "are only fetched for git sources")
+	}
+	if site.LFS && site.CloneURLType != "git" {
+		add("LFS", "is only fetched for git sources")
+	}
+
+	for phase, secs := range map[string]int{
+		"Sync":     site.Timeouts.Sync,
+		"Generate": site.Timeouts.Generate,
+		"Publish":  site.Timeouts.Publish,
+	} {
+		if secs < 0 || secs > maxPhaseTimeout {
+			add("Timeouts."+phase, "must be between 0 (the default) and %d seconds", maxPhaseTimeout)
+		}
+	}
+
+	// Sent as an HTTP header, where a line break would start another one
+	if strings.ContainsAny(site.AccessToken, "\r\n") {
+		add("AccessToken", "must be a single line")
+	}
+
+	if site.Email != "" {
+		if _, err := mail.ParseAddress(site.Email); err != nil {
+			add("Email", "%q is not a valid email address", site.Email)
+		}
+	}
+
+	if site.BaseURL != "" && !isBaseURL(site.BaseURL) {
+		add("BaseURL", "must be an http(s) URL or a path starting with /")
+	}
+
+	return errs
+}
+
+// Returns True if the name is a valid DNS host name. Host names are used as
+// directory names, so this also keeps them from escaping the site
+// directories.
+func isHostName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns True if the URL uses one of the allowed schemes. scp-like
+// addresses count as ssh.
+func isCloneURL(s string, schemes []string) bool {
+	// A leading dash would be taken as an option by the source control tool
+	if strings.HasPrefix(s, "-") {
+		return false
+	}
+
+	scheme := "ssh"
+	if !scpLikeURL.MatchString(s) {
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		scheme = u.Scheme
+	}
+
+	for _, allowed := range schemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns True if the name is acceptable as a git branch name, following
+// the rules of git check-ref-format.
+func isRefName(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "-"),
+		strings.HasPrefix(name, "/"),
+		strings.HasSuffix(name, "/"),
+		strings.HasSuffix(name, "."),
+		strings.HasSuffix(name, ".lock"),
+		strings.Contains(name, ".."),
+		strings.Contains(name, "//"),
+		strings.Contains(name, "@{"),
+		strings.ContainsAny(name, " ~^:?*[\\\t\n"):
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return name != "" && name != "@"
+}
+
+// Returns True if the path stays inside the directory it is relative to.
+func isSourceDir(dir string) bool {
+	if filepath.IsAbs(dir) || strings.HasPrefix(dir, "-") {
+		return false
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == ".." || part == "." || part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns True if the base URL is an absolute http(s) URL or a path.
+func isBaseURL(s string) bool {
+	if strings.HasPrefix(s, "/") {
+		return !strings.HasPrefix(s, "//")
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// invalidFields writes the 422 response listing the rejected fields.
+func invalidFields(w http.ResponseWriter, errs []FieldError) {
+	sendResponse(w, APIResponse{
+		Code:    422,
+		Message: "Invalid site configuration",
+		Errors:  errs,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsHostName(t *testing.T) {
+	tests := map[string]bool{
+		"blog.example.com": true,
+		"localhost":        true,
+		"a-b.example.com":  true,
+		"":                 false,
+		"..":               false,
+		"../etc":           false,
+		"-a.example.com":   false,
+		"a..example.com":   false,
+		"a_b.example.com":  false,
+		"a/b":              false,
+	}
+
+	for key, val := range tests {
+		if result := isHostName(key); result != val {
+			t.Errorf("Expected isHostName value of [%v] got [%v] for [%s]", val, result, key)
+		}
+	}
+}
+
+func TestIsCloneURL(t *testing.T) {
+	schemes := cloneURLSchemes["git"]
+	tests := map[string]bool{
+		"https://github.com/htruong/website.git": true,
+		"git://github.com/htruong/website.git":   true,
+		"ssh://git@example.com/site.git":         true,
+		"git@github.com:htruong/website.git":     true,
+		"file:///etc":                            false,
+		"/srv/repos/site.git":                    false,
+		"--upload-pack=touch /tmp/pwned":         false,
+		"https:///no-host":                       false,
+	}
+
+	for key, val := range tests {
+		if result := isCloneURL(key, schemes); result != val {
+			t.Errorf("Expected isCloneURL value of [%v] got [%v] for [%s]", val, result, key)
+		}
+	}
+}
+
+func TestIsRefName(t *testing.T) {
+	tests := map[string]bool{
+		"master":       true,
+		"gh-pages":     true,
+		"feature/blog": true,
+		"-b":           false,
+		"a..b":         false,
+		"a b":          false,
+		"a.lock":       false,
+		"feature/.x":   false,
+	}
+
+	for key, val := range tests {
+		if result := isRefName(key); result != val {
+			t.Errorf("Expected isRefName value of [%v] got [%v] for [%s]", val, result, key)
+		}
+	}
+}
+
+func TestIsSourceDir(t *testing.T) {
+	tests := map[string]bool{
+		"docs":       true,
+		"site/blog":  true,
+		"../other":   false,
+		"docs/../..": false,
+		"/etc":       false,
+		"./docs":     false,
+	}
+
+	for key, val := range tests {
+		if result := isSourceDir(key); result != val {
+			t.Errorf("Expected isSourceDir value of [%v] got [%v] for [%s]", val, result, key)
+		}
+	}
+}
+
+func TestValidateSite(t *testing.T) {
+	existing := []SiteConf{{HostName: "taken.example.com"}}
+
+	good := SiteConf{HostName: "blog.example.com", CloneURL: "https://github.com/u/blog.git"}
+	normalizeSite(&good)
+	if errs := validateSite(good, existing); len(errs) != 0 {
+		t.Errorf("Expected no errors got %v", errs)
+	}
+
+	bad := SiteConf{
+		HostName:     "taken.example.com",
+		CloneURLType: "svn",
+		Email:        "nope",
+		BaseURL:      "ftp://example.com",
+		SourceDir:    "../../etc",
+	}
+	errs := validateSite(bad, existing)
+	fields := map[string]bool{}
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"HostName", "CloneURLType", "CloneURL", "Email", "BaseURL", "SourceDir"} {
+		if !fields[field] {
+			t.Errorf("Expected an error for field [%s] got %v", field, errs)
+		}
+	}
+}
+
+func TestValidateSourceTypes(t *testing.T) {
+	defer func(dir string) { localroot = dir }(localroot)
+	localroot = ""
+
+	tests := map[SiteConf]string{
+		{HostName: "a.example.com", CloneURLType: "hg", CloneURL: "https://hg.example.com/blog", Branch: "stable"}:  "",
+		{HostName: "a.example.com", CloneURLType: "archive", CloneURL: "https://example.com/blog.zip"}:              "",
+		{HostName: "a.example.com", CloneURLType: "archive", CloneURL: "ssh://example.com/blog.zip"}:                "CloneURL",
+		{HostName: "a.example.com", CloneURLType: "archive", CloneURL: "https://example.com/b.zip", Branch: "main"}: "Branch",
+		{HostName: "a.example.com", CloneURLType: "local", CloneURL: "blog"}:                                        "CloneURLType",
+	}
+	for site, field := range tests {
+		errs := validateSite(site, nil)
+		switch {
+		case field == "" && len(errs) != 0:
+			t.Errorf("Expected no errors for %s got %v", site.CloneURL, errs)
+		case field != "" && (len(errs) != 1 || errs[0].Field != field):
+			t.Errorf("Expected an error for field [%s] for %s got %v", field, site.CloneURL, errs)
+		}
+	}
+
+	localroot = "/srv/sources"
+	for url, valid := range map[string]bool{"blog": true, "u/blog": true, "../blog": false, "/etc": false} {
+		site := SiteConf{HostName: "a.example.com", CloneURLType: "local", CloneURL: url}
+		if errs := validateSite(site, nil); (len(errs) == 0) != valid {
+			t.Errorf("Expected local source [%s] valid to be %v got %v", url, valid, errs)
+		}
+	}
+}